@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envPrefix starts the name of the environment variable for each flag.
+const envPrefix = "MFCTSCAN_"
+
+// envName returns the environment variable for a flag: its name in upper case
+// with dashes changed to underscores, after envPrefix.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// givenFlags returns a function reporting whether a flag has been set, under
+// its own name or an alias. Aliases, like -o and -output, are flags bound to
+// the same variable, so they share a flag.Value.
+func givenFlags() func(*flag.Flag) bool {
+	var given []flag.Value
+	flag.Visit(func(fl *flag.Flag) {
+		given = append(given, fl.Value)
+	})
+	return func(fl *flag.Flag) bool {
+		for _, v := range given {
+			if v == fl.Value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// applyEnv sets flags from their environment variables, leaving alone any that
+// were given on the command line. Flags that can be repeated take a
+// comma-separated list. Since flags it sets count as given, it runs before
+// applyConfig so the environment overrides a config file.
+func applyEnv() error {
+	onCommandLine := givenFlags()
+
+	var err error
+	flag.VisitAll(func(fl *flag.Flag) {
+		v, present := os.LookupEnv(envName(fl.Name))
+		if !present || onCommandLine(fl) || err != nil {
+			return
+		}
+		values := []string{v}
+		if _, repeatable := fl.Value.(*stringList); repeatable {
+			values = strings.Split(v, ",")
+		}
+		for _, v := range values {
+			if setErr := flag.Set(fl.Name, strings.TrimSpace(v)); setErr != nil {
+				err = fmt.Errorf("%s: %w", envName(fl.Name), setErr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// applyConfig sets flags from a config file, leaving alone any that were given
+// on the command line. The file is a simple subset of TOML: each line is a
+// flag name, an equals sign, and a value, which may be a quoted string, a
+// bare word like a number, duration, or true, or for flags that can be
+// repeated, an array of quoted strings on one line. Lines starting with # are
+// comments. Keys that aren't flags are warned about and skipped.
+func applyConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	onCommandLine := givenFlags()
+
+	lineScanner := bufio.NewScanner(f)
+	for lineNum := 1; lineScanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(lineScanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return fmt.Errorf("line %d: expected name = value", lineNum)
+		}
+		name := strings.TrimSpace(line[:i])
+		values, err := configValues(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if name == "config" {
+			return fmt.Errorf("line %d: config files can't include others", lineNum)
+		}
+		fl := flag.Lookup(name)
+		if fl == nil {
+			log.Printf("warning: %s line %d: unknown setting %q, ignoring it", path, lineNum, name)
+			continue
+		}
+		if onCommandLine(fl) {
+			// the command line wins
+			continue
+		}
+		for _, v := range values {
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("line %d: setting %s: %w", lineNum, name, err)
+			}
+		}
+	}
+	return lineScanner.Err()
+}
+
+// configValues parses the value of a config line, returning each element of
+// an array or the single value otherwise.
+func configValues(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") {
+		v, rest, err := configValue(s)
+		if err != nil {
+			return nil, err
+		}
+		if rest != "" && rest[0] != '#' {
+			return nil, fmt.Errorf("unexpected %q after value", rest)
+		}
+		return []string{v}, nil
+	}
+
+	var values []string
+	s = strings.TrimSpace(s[1:])
+	for !strings.HasPrefix(s, "]") {
+		if s == "" {
+			return nil, fmt.Errorf("array isn't closed")
+		}
+		v, rest, err := configValue(s)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		s = strings.TrimPrefix(rest, ",")
+		s = strings.TrimSpace(s)
+	}
+	if rest := strings.TrimSpace(s[1:]); rest != "" && rest[0] != '#' {
+		return nil, fmt.Errorf("unexpected %q after array", rest)
+	}
+	return values, nil
+}
+
+// configValue parses a single quoted string or bare word from the start of s,
+// returning it and what follows with leading spaces trimmed.
+func configValue(s string) (string, string, error) {
+	if strings.HasPrefix(s, `"`) {
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return "", "", fmt.Errorf("string isn't closed")
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", "", fmt.Errorf("bad string %s", s[:end+1])
+		}
+		return v, strings.TrimSpace(s[end+1:]), nil
+	}
+	end := strings.IndexAny(s, ",]# \t")
+	if end < 0 {
+		end = len(s)
+	}
+	if end == 0 {
+		return "", "", fmt.Errorf("missing value")
+	}
+	return s[:end], strings.TrimSpace(s[end:]), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withFlags swaps in a flag set with an aliased string flag, like -o and
+// -output, and an aliased bool flag, like -exact and -no-subdomains, parsed
+// from args. The original set is restored when the test ends.
+func withFlags(t *testing.T, args ...string) (*string, *bool) {
+	t.Helper()
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	output := flag.String("output", "", "")
+	flag.StringVar(output, "o", "", "")
+	exact := flag.Bool("no-subdomains", false, "")
+	flag.BoolVar(exact, "exact", false, "")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return output, exact
+}
+
+func TestApplyEnvAliases(t *testing.T) {
+	tests := []struct {
+		args       []string
+		env        map[string]string
+		wantOutput string
+		wantExact  bool
+	}{
+		{nil, map[string]string{"MFCTSCAN_OUTPUT": "env.csv"}, "env.csv", false},
+		{nil, map[string]string{"MFCTSCAN_O": "env.csv"}, "env.csv", false},
+		{[]string{"-o", "flag.csv"}, map[string]string{"MFCTSCAN_OUTPUT": "env.csv"}, "flag.csv", false},
+		{[]string{"-output", "flag.csv"}, map[string]string{"MFCTSCAN_O": "env.csv"}, "flag.csv", false},
+		{nil, map[string]string{"MFCTSCAN_EXACT": "true"}, "", true},
+		{[]string{"-exact=false"}, map[string]string{"MFCTSCAN_NO_SUBDOMAINS": "true"}, "", false},
+		{[]string{"-no-subdomains=false"}, map[string]string{"MFCTSCAN_EXACT": "true"}, "", false},
+	}
+	for _, tt := range tests {
+		output, exact := withFlags(t, tt.args...)
+		for k, v := range tt.env {
+			os.Setenv(k, v)
+		}
+		err := applyEnv()
+		for k := range tt.env {
+			os.Unsetenv(k)
+		}
+		if err != nil {
+			t.Fatalf("%v %v: %v", tt.args, tt.env, err)
+		}
+		if *output != tt.wantOutput || *exact != tt.wantExact {
+			t.Errorf("%v %v: got output %q, exact %v, want %q, %v", tt.args, tt.env, *output, *exact, tt.wantOutput, tt.wantExact)
+		}
+	}
+}
+
+func TestApplyConfigAliases(t *testing.T) {
+	tests := []struct {
+		args       []string
+		config     string
+		wantOutput string
+		wantExact  bool
+	}{
+		{nil, `output = "config.csv"`, "config.csv", false},
+		{[]string{"-o", "flag.csv"}, `output = "config.csv"`, "flag.csv", false},
+		{[]string{"-output", "flag.csv"}, `o = "config.csv"`, "flag.csv", false},
+		{nil, "exact = true", "", true},
+		{[]string{"-exact=false"}, "no-subdomains = true", "", false},
+		{[]string{"-no-subdomains=false"}, "exact = true", "", false},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		output, exact := withFlags(t, tt.args...)
+		path := filepath.Join(dir, "config"+string(rune('a'+i))+".toml")
+		if err := ioutil.WriteFile(path, []byte(tt.config+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyConfig(path); err != nil {
+			t.Fatalf("%v %q: %v", tt.args, tt.config, err)
+		}
+		if *output != tt.wantOutput || *exact != tt.wantExact {
+			t.Errorf("%v %q: got output %q, exact %v, want %q, %v", tt.args, tt.config, *output, *exact, tt.wantOutput, tt.wantExact)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package ctscan
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// An ASN identifies the autonomous system, and so roughly the network owner,
+// announcing an address.
+type ASN struct {
+	Number uint   `json:"number"`
+	Org    string `json:"org"`
+}
+
+// An ASNDB looks up addresses in a local MaxMind-format ASN database, such as
+// GeoLite2-ASN. Results are cached by address. It's safe for concurrent use.
+type ASNDB struct {
+	db    *maxminddb.Reader
+	lock  sync.Mutex
+	cache map[string]ASN
+}
+
+// OpenASNDB opens the ASN database at path.
+func OpenASNDB(path string) (*ASNDB, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ASNDB{
+		db:    db,
+		cache: map[string]ASN{},
+	}, nil
+}
+
+// Lookup returns the ASN announcing addr. Addresses the database doesn't
+// cover get a zero ASN.
+func (a *ASNDB) Lookup(addr string) (ASN, error) {
+	a.lock.Lock()
+	asn, cached := a.cache[addr]
+	a.lock.Unlock()
+	if cached {
+		return asn, nil
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ASN{}, fmt.Errorf("invalid address %q", addr)
+	}
+	var result struct {
+		Number uint   `maxminddb:"autonomous_system_number"`
+		Org    string `maxminddb:"autonomous_system_organization"`
+	}
+	if err := a.db.Lookup(ip, &result); err != nil {
+		return ASN{}, err
+	}
+	asn = ASN{Number: result.Number, Org: result.Org}
+
+	a.lock.Lock()
+	a.cache[addr] = asn
+	a.lock.Unlock()
+	return asn, nil
+}
+
+// Close releases the database.
+func (a *ASNDB) Close() error {
+	return a.db.Close()
+}
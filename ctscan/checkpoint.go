@@ -0,0 +1,155 @@
+package ctscan
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// ReadCheckpoint reads the domains recorded in a checkpoint written by a
+// Scanner. Each completed domain is a single line. A final line without a
+// newline was cut off mid-write and is ignored.
+func ReadCheckpoint(r io.Reader) ([]string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		b = b[:i+1]
+	} else {
+		b = nil
+	}
+	var domains []string
+	lineScanner := bufio.NewScanner(bytes.NewReader(b))
+	for lineScanner.Scan() {
+		if domain := strings.TrimSpace(lineScanner.Text()); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, lineScanner.Err()
+}
+
+// A pendingTree is a domain from the input and the domains found from it by
+// recursive discovery, waiting to be checkpointed.
+type pendingTree struct {
+	domains []string
+	// held counts the records sent for the tree's domains that haven't been
+	// released yet.
+	held     int
+	scanning bool
+	failed   bool
+}
+
+// startTree begins tracking a recursive scan, if there's a checkpoint to
+// write. It returns nil otherwise, which the other tree methods ignore.
+func (s *Scanner) startTree() *pendingTree {
+	if s.Checkpoint == nil {
+		return nil
+	}
+	return &pendingTree{scanning: true}
+}
+
+// joinTree adds a domain to a tree, so its records are counted against it.
+func (s *Scanner) joinTree(tree *pendingTree, domain string) {
+	if tree == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.trees == nil {
+		s.trees = map[string]*pendingTree{}
+	}
+	tree.domains = append(tree.domains, domain)
+	s.trees[domain] = tree
+}
+
+// hold counts a record about to be sent for one of a tree's domains.
+func (s *Scanner) hold(tree *pendingTree) {
+	if tree == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tree.held++
+}
+
+// failTree marks a tree as incomplete, so none of it is checkpointed.
+func (s *Scanner) failTree(tree *pendingTree) {
+	if tree == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tree.failed = true
+}
+
+// finishTree marks a tree as done scanning, and as failed if ok isn't set.
+func (s *Scanner) finishTree(tree *pendingTree, ok bool) {
+	if tree == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tree.scanning = false
+	tree.failed = tree.failed || !ok
+	s.settle(tree)
+}
+
+// Release reports that records the Scanner sent have been written out, so
+// their domains can be checkpointed once nothing else is outstanding. It
+// returns the first error from writing the checkpoint, including any from
+// earlier calls or from Drop.
+func (s *Scanner) Release(records ...Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, record := range records {
+		s.release(record)
+	}
+	return s.checkpointErr
+}
+
+// Drop reports that a record the Scanner sent was filtered out and won't be
+// written, which releases it like Release. It's safe to use as a callback
+// from concurrent stages.
+func (s *Scanner) Drop(record Record) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.release(record)
+}
+
+// release uncounts a record from its tree. The lock must be held.
+func (s *Scanner) release(record Record) {
+	tree := s.trees[record.From]
+	if tree == nil {
+		return
+	}
+	tree.held--
+	s.settle(tree)
+}
+
+// settle checkpoints a tree once it's done scanning and all of its records
+// are released, unless it failed. The lock must be held. Each domain's line
+// goes out in a single write so a crash can only leave a partial last line
+// behind.
+func (s *Scanner) settle(tree *pendingTree) {
+	if tree.scanning || tree.held > 0 {
+		return
+	}
+	for _, domain := range tree.domains {
+		delete(s.trees, domain)
+	}
+	if tree.failed {
+		return
+	}
+	for _, domain := range tree.domains {
+		if s.checkpointErr != nil {
+			return
+		}
+		if _, err := io.WriteString(s.Checkpoint, domain+"\n"); err != nil {
+			s.checkpointErr = fmt.Errorf("writing checkpoint: %w", err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package ctscan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// crtshTimeLayout is how crt.sh formats certificate validity times, in UTC.
+const crtshTimeLayout = "2006-01-02T15:04:05"
+
+// DefaultCrtshURL is the BaseURL of a new CrtshSource.
+const DefaultCrtshURL = "https://crt.sh"
+
+// CrtshSource looks domains up using the crt.sh certificate search JSON API.
+type CrtshSource struct {
+	// BaseURL is where crt.sh is served from. It can be pointed at a test
+	// server.
+	BaseURL string
+	// Log receives progress messages. It may be nil.
+	Log *Logger
+	// Headers are added to every request.
+	Headers map[string]string
+	// Limiter, if set, is waited on before each request. Share one Limiter
+	// between sources to cap the overall request rate.
+	Limiter *rate.Limiter
+	// MaxRecords caps the records returned for a domain. Zero means no
+	// limit.
+	MaxRecords int
+	// Since drops records for certificates issued before it. crt.sh has no
+	// way to ask for this, so it's done after the results arrive. Zero keeps
+	// everything.
+	Since time.Time
+
+	client *http.Client
+}
+
+// NewCrtshSource returns a CrtshSource that makes requests with client.
+func NewCrtshSource(client *http.Client) *CrtshSource {
+	return &CrtshSource{
+		BaseURL: DefaultCrtshURL,
+		client:  client,
+	}
+}
+
+// crtshEntry is a single certificate from a crt.sh JSON response. Only the
+// fields the scanner uses are decoded.
+type crtshEntry struct {
+	IssuerName string `json:"issuer_name"`
+	NameValue  string `json:"name_value"`
+	NotBefore  string `json:"not_before"`
+	NotAfter   string `json:"not_after"`
+	Serial     string `json:"serial_number"`
+}
+
+// Scan retrieves every certificate crt.sh knows about for a domain and its
+// subdomains. crt.sh returns all results in a single response.
+func (c *CrtshSource) Scan(ctx context.Context, domain string) ([]Record, error) {
+	q := url.Values{}
+	if includeSubdomains(ctx) {
+		q.Set("q", "%."+domain)
+	} else {
+		q.Set("q", domain)
+	}
+	q.Set("output", "json")
+	u, err := buildURL(c.BaseURL, "/", q)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	for h, v := range c.Headers {
+		req.Header.Set(h, v)
+	}
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("waiting for rate limit: %w", err)
+		}
+	}
+	c.Log.Debugf("GET %s", u)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("non-200 response %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	var entries []crtshEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("parsing JSON: %w", err)
+	}
+	// crt.sh doesn't page, so the response is the one page
+	countPage(ctx)
+	records, _ := issuedSince(crtshRecords(entries), c.Since)
+	if c.MaxRecords > 0 && len(records) > c.MaxRecords {
+		records = records[:c.MaxRecords]
+	}
+	return records, nil
+}
+
+// crtshRecords converts crt.sh entries to Records. Each entry lists all of a
+// certificate's names separated by newlines, and each name becomes a Record.
+func crtshRecords(entries []crtshEntry) []Record {
+	var records []Record
+	for _, entry := range entries {
+		notBefore := crtshTime(entry.NotBefore)
+		notAfter := crtshTime(entry.NotAfter)
+		for _, name := range strings.Split(entry.NameValue, "\n") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			record := Record{
+				Name:          name,
+				Issuer:        entry.IssuerName,
+				NotBeforeTime: notBefore,
+				NotAfterTime:  notAfter,
+				SerialNumber:  entry.Serial,
+			}
+			setIssuer(&record, entry.IssuerName)
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// crtshTime converts a crt.sh timestamp to milliseconds since the epoch, the
+// same units Google uses. Unparseable times become zero.
+func crtshTime(s string) int64 {
+	t, err := time.Parse(crtshTimeLayout, s)
+	if err != nil {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,23 @@
+package ctscan
+
+import "testing"
+
+func TestCrtshRecordsSerial(t *testing.T) {
+	records := crtshRecords([]crtshEntry{
+		{NameValue: "example.com\nwww.example.com\n", Serial: "03a1b2c3d4"},
+		{NameValue: "mail.example.com"},
+	})
+	var got []string
+	for _, record := range records {
+		got = append(got, record.Name+" "+record.SerialNumber)
+	}
+	want := []string{"example.com 03a1b2c3d4", "www.example.com 03a1b2c3d4", "mail.example.com "}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("record %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
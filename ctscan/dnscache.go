@@ -0,0 +1,65 @@
+package ctscan
+
+import (
+	"sync"
+	"time"
+)
+
+// dnsCacheSize bounds the number of lookups a Resolver's cache holds.
+const dnsCacheSize = 100000
+
+// A dnsCache remembers address lookups for a while. It's safe for concurrent
+// use.
+type dnsCache struct {
+	lock    sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: map[string]dnsCacheEntry{}}
+}
+
+// get returns the cached result of looking up key, if there's one that
+// hasn't expired.
+func (c *dnsCache) get(key string) (dnsCacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, present := c.entries[key]
+	if present && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return dnsCacheEntry{}, false
+	}
+	return entry, present
+}
+
+// put caches the result of looking up key for ttl. When the cache is full,
+// expired entries are dropped, and if that isn't enough, arbitrary ones.
+func (c *dnsCache) put(key string, addrs []string, err error, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if len(c.entries) >= dnsCacheSize {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < dnsCacheSize {
+			break
+		}
+		delete(c.entries, k)
+	}
+	c.entries[key] = dnsCacheEntry{
+		addrs:   addrs,
+		err:     err,
+		expires: now.Add(ttl),
+	}
+}
@@ -0,0 +1,9 @@
+// Package ctscan scans Google's Certificate Transparency system for hostnames
+// under a given domain and resolves the names it discovers.
+//
+// A Scanner reads domains from a channel and streams out a Record for each
+// certificate name found. A Resolver reads those Records, performs DNS
+// resolution, and streams them out again with addresses attached. The two are
+// meant to be chained together with several goroutines running each stage,
+// with the results written to an Output.
+package ctscan
@@ -0,0 +1,60 @@
+package ctscan
+
+import (
+	"strings"
+	"sync"
+)
+
+// Filter copies records from in to out, dropping those that keep rejects. It
+// returns the number of records dropped once in is closed. Filters can be
+// chained between a Scanner and a Resolver to avoid resolving unwanted names.
+func Filter(in <-chan Record, out chan<- Record, keep func(Record) bool) int {
+	dropped := 0
+	for record := range in {
+		if !keep(record) {
+			dropped++
+			continue
+		}
+		out <- record
+	}
+	return dropped
+}
+
+// A Scope is a set of domains. A name is in scope if it's one of the domains
+// or a subdomain of one. It's safe for concurrent use.
+type Scope struct {
+	lock    sync.RWMutex
+	domains map[string]struct{}
+}
+
+// NewScope returns an empty Scope.
+func NewScope() *Scope {
+	return &Scope{
+		domains: map[string]struct{}{},
+	}
+}
+
+// Add puts a domain in scope.
+func (s *Scope) Add(domain string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.domains[normalizeDomain(domain)] = struct{}{}
+}
+
+// Contains reports whether name is a domain in the scope or a subdomain of
+// one. Wildcard names are checked without their wildcard label.
+func (s *Scope) Contains(name string) bool {
+	name = normalizeDomain(name)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for {
+		if _, present := s.domains[name]; present {
+			return true
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
@@ -0,0 +1,22 @@
+package ctscan
+
+import "testing"
+
+func TestScopeContains(t *testing.T) {
+	scope := NewScope()
+	scope.Add("Example.com.")
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a.b.EXAMPLE.com.", true},
+		{"*.www.example.com", true},
+		{"notexample.com", false},
+		{"example.com.evil.test", false},
+	}
+	for _, tt := range tests {
+		if got := scope.Contains(tt.name); got != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package ctscan
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"golang.org/x/time/rate"
+)
+
+// errCookieExpired means Google rejected a request's cookie.
+var errCookieExpired = errors.New("google cookie expired")
+
+// errMalformedJSON means a response body couldn't be parsed as JSON at all,
+// usually because it was cut short. Unlike JSON that parses but isn't shaped
+// as expected, it's worth retrying.
+var errMalformedJSON = errors.New("malformed JSON")
+
+// cookieRetryDelay is how long to wait before the first retry of a failed
+// cookie fetch. It doubles for each retry after that.
+const cookieRetryDelay = time.Second
+
+// A cookieError is a failure to get the Google cookie.
+type cookieError struct {
+	err error
+}
+
+func (e cookieError) Error() string { return e.err.Error() }
+func (e cookieError) Unwrap() error { return e.err }
+
+// IsCookieError reports whether err came from failing to get the Google
+// cookie, which usually means Google is refusing the client rather than a
+// problem with any one domain.
+func IsCookieError(err error) bool {
+	return errors.As(err, &cookieError{})
+}
+
+// parseRetryDelay is how long to wait before fetching a page again after its
+// body couldn't be parsed.
+const parseRetryDelay = time.Second
+
+var (
+	googleHeaders = map[string]string{
+		"User-Agent":      "Mozilla/5.0 (Windows NT 6.1; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/62.0.3202.62 Safari/537.36",
+		"Accept":          "application/json, text/plain, */*",
+		"Accept-Language": "en-US,en;q=0.5",
+		// only what fetch can decode
+		"Accept-Encoding": "gzip",
+		"Referer":         "https://transparencyreport.google.com",
+		"Sec-Fetch-Site":  "same-origin",
+		"Sec-Fetch-Mode":  "cors",
+		"Sec-Fetch-Dest":  "empty",
+		"Connection":      "keep-alive",
+		"DNT":             "1",
+	}
+)
+
+// DefaultGoogleURL is the BaseURL of a new GoogleSource.
+const DefaultGoogleURL = "https://transparencyreport.google.com"
+
+// DefaultGoogleLang is the Lang of a new GoogleSource.
+const DefaultGoogleLang = "en_GB"
+
+// GoogleSource looks domains up in Google's certificate transparency report.
+// Requests need a cookie, so the client must have a cookie jar and GetCookie
+// must be called before scanning.
+type GoogleSource struct {
+	// BaseURL is where the transparency report is served from. It can be
+	// pointed at a mirror or a test server.
+	BaseURL string
+	// Lang is the interface language requested, as the hl parameter.
+	Lang string
+	// Log receives progress messages. It may be nil.
+	Log *Logger
+	// Headers are added to every request, replacing the browser-like
+	// defaults that share their names.
+	Headers map[string]string
+	// Limiter, if set, is waited on before each request. Share one Limiter
+	// between sources to cap the overall request rate.
+	Limiter *rate.Limiter
+	// MaxRecords stops paging through a domain's results once this many
+	// records have been retrieved. Zero means no limit.
+	MaxRecords int
+	// PageDelay is how long to wait between fetching one page of a domain's
+	// results and the next.
+	PageDelay time.Duration
+	// CookieTimeout bounds each attempt to fetch the cookie. Zero means no
+	// limit.
+	CookieTimeout time.Duration
+	// CookieRetries is how many more times to try fetching the cookie after
+	// a failure that may be temporary, like a network error or a server
+	// error response.
+	CookieRetries int
+	// KeepRaw sets the Raw field of each record to the JSON array it was
+	// parsed from, for seeing what produced a surprising Record.
+	KeepRaw bool
+	// ParseRetries is how many more times to fetch a page whose body
+	// couldn't be parsed as JSON before giving up on the domain.
+	ParseRetries int
+	// Since drops records for certificates issued before it. The API has no
+	// way to ask for this, so it's done as pages arrive, and since results
+	// come newest first, paging stops at the first page with an older
+	// record. Zero keeps everything.
+	Since time.Time
+
+	client    *http.Client
+	maxPages  int
+	lock      sync.Mutex
+	cookieGen int
+}
+
+// NewGoogleSource returns a GoogleSource that makes requests with client and
+// retrieves at most maxPages pages of results per domain.
+func NewGoogleSource(client *http.Client, maxPages int) *GoogleSource {
+	return &GoogleSource{
+		BaseURL:       DefaultGoogleURL,
+		Lang:          DefaultGoogleLang,
+		CookieTimeout: 30 * time.Second,
+		CookieRetries: 2,
+		ParseRetries:  2,
+		client:        client,
+		maxPages:      maxPages,
+	}
+}
+
+// Scan retrieves pages of results for a domain, and its subdomains unless ctx
+// says otherwise, until there are no more or the page or record limit is
+// reached.
+func (g *GoogleSource) Scan(ctx context.Context, domain string) ([]Record, error) {
+	token := ""
+	var all []Record
+	pages := 0
+	for i := 0; i < g.maxPages; i++ {
+		q := url.Values{}
+		var reqPath string
+		if token == "" {
+			// There's no continuation token. This is the first request
+			reqPath = "/transparencyreport/api/v3/httpsreport/ct/certsearch"
+			q.Set("include_subdomains", strconv.FormatBool(includeSubdomains(ctx)))
+			q.Set("domain", domain)
+		} else {
+			// Continue retrieving pages of results
+			reqPath = "/transparencyreport/api/v3/httpsreport/ct/certsearch/page"
+			q.Set("p", token)
+			if err := sleep(ctx, g.PageDelay); err != nil {
+				return all, err
+			}
+		}
+
+		q.Set("hl", g.Lang)
+		u, err := buildURL(g.BaseURL, reqPath, q)
+		if err != nil {
+			return all, err
+		}
+		page, err := g.fetchPage(ctx, u)
+		if err != nil {
+			return all, err
+		}
+		pages++
+		countPage(ctx)
+		if page.number == 0 {
+			// best effort; fall back to counting
+			page.number = pages
+		}
+		for i := range page.records {
+			page.records[i].Page = page.number
+		}
+		if page.total > 0 {
+			g.Log.Debugf("%s: page %d of %d has %d records, continuation token %q", domain, page.number, page.total, len(page.records), page.token)
+		} else {
+			g.Log.Debugf("%s: page %d has %d records, continuation token %q", domain, page.number, len(page.records), page.token)
+		}
+		if page.skipped > 0 {
+			g.Log.Warnf("%s: skipped %d malformed records on page %d", domain, page.skipped, pages)
+		}
+		records, older := issuedSince(page.records, g.Since)
+		all = append(all, records...)
+
+		if g.MaxRecords > 0 && len(all) >= g.MaxRecords {
+			// got as many as we want, skip the rest of the pages
+			all = all[:g.MaxRecords]
+			break
+		}
+		if older {
+			// the rest of the pages are older still
+			g.Log.Debugf("%s: page %d reached certificates issued before %s", domain, pages, g.Since.Format(time.RFC3339))
+			break
+		}
+		if page.token == "" {
+			// no continuation token, this domain is done
+			break
+		}
+		token = page.token
+		if pages == g.maxPages {
+			// the loop ends here, but there's more to get
+			if page.total > 0 {
+				g.Log.Warnf("%s: stopped at the page limit of %d out of %d pages, results are incomplete", domain, pages, page.total)
+			} else {
+				g.Log.Warnf("%s: stopped at the page limit of %d with more pages left, results are incomplete", domain, pages)
+			}
+		}
+	}
+	return all, nil
+}
+
+// fetchPage retrieves and parses a page of results. A rejected cookie is
+// refreshed and the page tried once more, and a body that isn't valid JSON is
+// fetched again up to ParseRetries times.
+func (g *GoogleSource) fetchPage(ctx context.Context, u *url.URL) (ctPage, error) {
+	for attempt := 0; ; attempt++ {
+		gen := g.cookieGeneration()
+		b, err := g.fetch(ctx, u)
+		if errors.Is(err, errCookieExpired) {
+			// get a fresh cookie and try once more
+			if err := g.refreshCookie(ctx, gen); err != nil {
+				return ctPage{}, fmt.Errorf("refreshing cookie: %w", err)
+			}
+			b, err = g.fetch(ctx, u)
+		}
+		if err != nil {
+			return ctPage{}, err
+		}
+
+		page, err := parseCTData(b, g.KeepRaw)
+		if err == nil {
+			return page, nil
+		}
+		g.Log.Debugf("unparseable response of %d bytes starting %q", len(b), bodyPrefix(b))
+		if !errors.Is(err, errMalformedJSON) || attempt >= g.ParseRetries {
+			return ctPage{}, fmt.Errorf("parsing CT data: %w", err)
+		}
+		g.Log.Warnf("retrying %s after parsing CT data: %v", u.Path, err)
+		if err := sleep(ctx, parseRetryDelay); err != nil {
+			return ctPage{}, err
+		}
+	}
+}
+
+// bodyPrefix returns the start of a response body, for logging.
+func bodyPrefix(b []byte) []byte {
+	const max = 64
+	if len(b) > max {
+		return b[:max]
+	}
+	return b
+}
+
+// fetch retrieves a page of results, returning the body with any XSSI prefix
+// removed. It returns errCookieExpired if Google rejects the cookie.
+func (g *GoogleSource) fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		u.String(),
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	g.setHeaders(req)
+	if g.Limiter != nil {
+		if err := g.Limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("waiting for rate limit: %w", err)
+		}
+	}
+	g.Log.Debugf("GET %s", u)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden || resp.Request.URL.Host != u.Host {
+		// rejected outright, or redirected off to a login page
+		return nil, errCookieExpired
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("non-200 response %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	r := resp.Body
+	switch encoding := resp.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		r, err = gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("creating gzip reader: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported response Content-Encoding %q", encoding)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+	if bytes.HasPrefix(b, []byte(")]}'")) {
+		// To prevent XSSI, a prefix is added that needs to be stripped
+		b = b[4:]
+	}
+	return b, nil
+}
+
+// cookieGeneration returns a number that changes each time the cookie is
+// refreshed.
+func (g *GoogleSource) cookieGeneration() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.cookieGen
+}
+
+// refreshCookie fetches a new cookie after a request made with cookie
+// generation gen was rejected. Scanners that hit an expired cookie at the same
+// time wait for a single refresh instead of each fetching their own.
+func (g *GoogleSource) refreshCookie(ctx context.Context, gen int) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.cookieGen != gen {
+		// someone else already refreshed it
+		return nil
+	}
+	g.Log.Warnf("google cookie rejected, fetching a new one")
+	if err := g.GetCookieContext(ctx); err != nil {
+		return err
+	}
+	g.cookieGen++
+	return nil
+}
+
+// setHeaders applies the headers google expects to a request, followed by
+// any overrides.
+func (g *GoogleSource) setHeaders(req *http.Request) {
+	for h, v := range googleHeaders {
+		req.Header.Set(h, v)
+	}
+	for h, v := range g.Headers {
+		req.Header.Set(h, v)
+	}
+}
+
+/*
+[
+  [
+    "https.ct.cdsr",
+    [
+      [
+        null,
+        "debug.example.org",
+        "Let's Encrypt Authority X3",
+        1605043123456,
+        1612819123456,
+        "<base64>",
+        2,
+        null,
+        1
+      ],
+      [
+        null,
+        "debug.example.org",
+        "Let's Encrypt Authority X3",
+        1605043123456,
+        1612819123456,
+        "<base64>",
+        2,
+        null,
+        1
+      ]
+    ],
+    [
+      [
+        "1234567890193923849",
+        null,
+        "C=US, O=Let's Encrypt, CN=R3",
+        6
+      ],
+      [
+        "9328174140391839128",
+        null,
+        "C=US, O=Let's Encrypt, CN=Let's Encrypt Authority X3",
+        44
+      ]
+    ],
+    [
+      null,
+      "<base64>",
+      null,
+      1,
+      5
+    ]
+  ]
+]
+*/
+
+// A ctPage is a parsed page of certificate transparency results.
+type ctPage struct {
+	records []Record
+	token   string
+	// number and total are where the page falls in the results, if the
+	// response says. They're zero otherwise.
+	number int
+	total  int
+	// skipped counts records that were malformed and left out
+	skipped int
+}
+
+// parseCTData parses a page of certificate transparency data from a goolge
+// response. The JSON returned is all nested arrays instead of having a
+// sensible object structure. If the page as a whole isn't shaped as
+// expected an error is returned, but malformed records are only skipped and
+// counted so the rest of the page can still be used. With keepRaw, each
+// record's Raw is set to the array it was parsed from.
+func parseCTData(b []byte, keepRaw bool) (ctPage, error) {
+	var page ctPage
+	j, err := simplejson.NewJson(b)
+	if err != nil {
+		return page, fmt.Errorf("%w: %v", errMalformedJSON, err)
+	}
+
+	if _, err := j.Array(); err != nil {
+		return page, fmt.Errorf("response not an array")
+	}
+	if _, err := j.GetIndex(0).Array(); err != nil {
+		return page, fmt.Errorf("response[0] not an array")
+	}
+	recordsJSON := j.GetIndex(0).GetIndex(1)
+	recordsArray, err := recordsJSON.Array()
+	if err != nil {
+		return page, fmt.Errorf("records not an array")
+	}
+	issuers := parseIssuerTable(j.GetIndex(0).GetIndex(2))
+	for i := range recordsArray {
+		record, ok := parseCTRecord(recordsJSON.GetIndex(i))
+		if !ok {
+			page.skipped++
+			continue
+		}
+		setIssuer(&record, issuers[record.Issuer])
+		if keepRaw {
+			if raw, err := recordsJSON.GetIndex(i).Encode(); err == nil {
+				record.Raw = string(raw)
+			}
+		}
+		page.records = append(page.records, record)
+	}
+
+	pageInfo := j.GetIndex(0).GetIndex(3)
+	page.token = pageInfo.GetIndex(1).MustString()
+	page.number = pageInfo.GetIndex(3).MustInt()
+	page.total = pageInfo.GetIndex(4).MustInt()
+
+	return page, nil
+}
+
+// parseCTRecord parses a single record's array. It reports false if the
+// record is missing its name or validity times.
+func parseCTRecord(r *simplejson.Json) (Record, bool) {
+	if _, err := r.Array(); err != nil {
+		return Record{}, false
+	}
+	name, err := r.GetIndex(1).String()
+	if err != nil || name == "" {
+		return Record{}, false
+	}
+	notBefore, err := r.GetIndex(3).Int64()
+	if err != nil {
+		return Record{}, false
+	}
+	notAfter, err := r.GetIndex(4).Int64()
+	if err != nil {
+		return Record{}, false
+	}
+	return Record{
+		Name:          name,
+		Issuer:        r.GetIndex(2).MustString(),
+		NotBeforeTime: notBefore,
+		NotAfterTime:  notAfter,
+		Fingerprint:   fingerprint(r.GetIndex(5).MustString()),
+	}, true
+}
+
+// parseIssuerTable reads the table of issuers that accompanies each page of
+// results, returning their distinguished names keyed by common name. Records
+// only carry the issuer's common name, so this is how they're matched up.
+func parseIssuerTable(table *simplejson.Json) map[string]string {
+	issuers := map[string]string{}
+	entries, err := table.Array()
+	if err != nil {
+		return issuers
+	}
+	for i := range entries {
+		dn := table.GetIndex(i).GetIndex(2).MustString()
+		if cn := parseDN(dn)["CN"]; cn != "" {
+			issuers[cn] = dn
+		}
+	}
+	return issuers
+}
+
+// fingerprint converts the base64 certificate hash Google includes with each
+// record to the usual hex form. Anything that doesn't decode is returned as is.
+func fingerprint(b64 string) string {
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return b64
+	}
+	return hex.EncodeToString(b)
+}
+
+// GetCookie retrieves a cookie used for subsequent CT scan requests, storing
+// it in the client's cookie jar. The cookie only needs to be fetched once; if
+// it expires during a scan, Scan fetches a new one.
+func (g *GoogleSource) GetCookie() error {
+	return g.GetCookieContext(context.Background())
+}
+
+// GetCookieContext is GetCookie, giving up when ctx is done. Each attempt is
+// bounded by CookieTimeout, and temporary failures are retried up to
+// CookieRetries times. Errors it returns satisfy IsCookieError.
+func (g *GoogleSource) GetCookieContext(ctx context.Context) error {
+	if g.client.Jar == nil {
+		return cookieError{fmt.Errorf("no cookie jar set")}
+	}
+	start := time.Now()
+	delay := cookieRetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := g.fetchCookie(ctx)
+		if err == nil {
+			g.Log.Infof("got google cookie in %s", time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		if !retry || attempt >= g.CookieRetries || ctx.Err() != nil {
+			return cookieError{err}
+		}
+		g.Log.Warnf("getting google cookie: %v, retrying in %s", err, delay)
+		if err := sleep(ctx, delay); err != nil {
+			return cookieError{err}
+		}
+		delay *= 2
+	}
+}
+
+// fetchCookie makes a single attempt at getting the cookie, reporting whether
+// a failure is worth retrying.
+func (g *GoogleSource) fetchCookie(ctx context.Context) (bool, error) {
+	if g.CookieTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.CookieTimeout)
+		defer cancel()
+	}
+	q := url.Values{}
+	q.Set("hl", g.Lang)
+	u, err := buildURL(g.BaseURL, "/https/certificates", q)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		u.String(),
+		nil,
+	)
+	if err != nil {
+		return false, fmt.Errorf("creating request: %w", err)
+	}
+	g.setHeaders(req)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		// network errors and timeouts
+		return true, fmt.Errorf("sending request: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("non-200 response %d: %s", resp.StatusCode, resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,267 @@
+package ctscan
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGoogle serves the transparency report API from canned bodies. Each
+// request for a domain's first page, or for a continuation token, takes the
+// next of its bodies, repeating the last once they run out. A body starting
+// with a status code, like "500 ", is sent with that status instead. Page
+// requests without the latest cookie are rejected.
+type fakeGoogle struct {
+	*httptest.Server
+	mu       sync.Mutex
+	bodies   map[string][]string
+	cookie   int
+	requests int
+	// expire rejects the next page request's cookie, as if it had expired
+	expire bool
+	// gzip compresses the page bodies
+	gzip bool
+}
+
+func newFakeGoogle(t *testing.T, bodies map[string][]string) *fakeGoogle {
+	t.Helper()
+	f := &fakeGoogle{bodies: bodies}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeGoogle) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if r.URL.Path == "/https/certificates" {
+		f.cookie++
+		http.SetCookie(w, &http.Cookie{Name: "NID", Value: fmt.Sprint(f.cookie), Path: "/"})
+		return
+	}
+	if c, err := r.Cookie("NID"); err != nil || c.Value != fmt.Sprint(f.cookie) || f.expire {
+		f.expire = false
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	key := r.URL.Query().Get("domain")
+	if strings.HasSuffix(r.URL.Path, "/certsearch/page") {
+		key = r.URL.Query().Get("p")
+	}
+	bodies := f.bodies[key]
+	if len(bodies) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body := bodies[0]
+	if len(bodies) > 1 {
+		f.bodies[key] = bodies[1:]
+	}
+	var status int
+	if _, err := fmt.Sscanf(body, "%d ", &status); err == nil {
+		w.WriteHeader(status)
+		return
+	}
+	if f.gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(body))
+		zw.Close()
+		body = buf.String()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Write([]byte(body))
+}
+
+// source returns a GoogleSource for the server with its cookie already
+// fetched.
+func (f *fakeGoogle) source(t *testing.T) *GoogleSource {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGoogleSource(&http.Client{Jar: jar}, 10)
+	g.BaseURL = f.URL
+	if err := g.GetCookie(); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func (f *fakeGoogle) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// ctPageJSON builds a page of results with the XSSI prefix, with a record
+// for each name and a continuation token.
+func ctPageJSON(token string, names ...string) string {
+	var records []string
+	for _, name := range names {
+		records = append(records, fmt.Sprintf(`[null,%q,"R3",1600000000000,1700000000000,"AAEC",2,null,1]`, name))
+	}
+	return fmt.Sprintf(`)]}'
+[["https.ct.cdsr",[%s],[["1",null,"C=US, O=Let's Encrypt, CN=R3",6]],[null,%q]]]`,
+		strings.Join(records, ","), token)
+}
+
+func TestGoogleSourcePages(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		google := newFakeGoogle(t, map[string][]string{
+			"example.com": {ctPageJSON("tok2", "www.example.com", "mail.example.com")},
+			"tok2":        {ctPageJSON("", "api.example.com")},
+		})
+		google.gzip = compressed
+
+		records, err := google.source(t).Scan(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, record := range records {
+			got = append(got, record.Name)
+			if record.IssuerOrg != "Let's Encrypt" || record.Fingerprint != "000102" {
+				t.Errorf("gzip %v: %s has issuer %q and fingerprint %q", compressed, record.Name, record.IssuerOrg, record.Fingerprint)
+			}
+		}
+		if want := "www.example.com mail.example.com api.example.com"; strings.Join(got, " ") != want {
+			t.Errorf("gzip %v: got names %q, want %s", compressed, got, want)
+		}
+		// the cookie, then two pages; the empty token stops it there
+		if n := google.requestCount(); n != 3 {
+			t.Errorf("gzip %v: made %d requests, want 3", compressed, n)
+		}
+	}
+}
+
+func TestGoogleSourceCookieExpiry(t *testing.T) {
+	google := newFakeGoogle(t, map[string][]string{
+		"example.com": {ctPageJSON("", "www.example.com")},
+	})
+	g := google.source(t)
+	google.expire = true
+	before := google.requestCount()
+	records, err := g.Scan(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Name != "www.example.com" {
+		t.Errorf("got %+v after refreshing the cookie, want www.example.com", records)
+	}
+	// the rejected page, a new cookie, and the page again
+	if n := google.requestCount() - before; n != 3 {
+		t.Errorf("made %d requests, want 3", n)
+	}
+}
+
+func TestGoogleSourceBadResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"server error", "500 ", "non-200 response 500"},
+		{"still rejected after a new cookie", "403 ", "google cookie expired"},
+		{"not JSON", "<html>", "parsing CT data"},
+	}
+	for _, tt := range tests {
+		google := newFakeGoogle(t, map[string][]string{"example.com": {tt.body}})
+		_, err := google.source(t).Scan(context.Background(), "example.com")
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"3q2+7w==", "deadbeef"},
+		// not base64, so it's kept as it is
+		{"not base64!", "not base64!"},
+	}
+	for _, tt := range tests {
+		if got := fingerprint(tt.in); got != tt.want {
+			t.Errorf("fingerprint(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseCTData(t *testing.T) {
+	const good = `[null,"www.example.com","R3",1600000000000,1700000000000,"AAEC",2,null,1]`
+	tests := []struct {
+		name        string
+		body        string
+		wantNames   []string
+		wantSkipped int
+		wantErr     string
+	}{
+		{"malformed records skipped", `[["https.ct.cdsr",[` + good + `,"oops",[null,"a.example.com","R3"]]]]`, []string{"www.example.com"}, 2, ""},
+		{"not an array", `{"error":"nope"}`, nil, 0, "response not an array"},
+		{"records not an array", `[["https.ct.cdsr","oops"]]`, nil, 0, "records not an array"},
+	}
+	for _, tt := range tests {
+		page, err := parseCTData([]byte(tt.body), false)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			continue
+		}
+		var names []string
+		for _, record := range page.records {
+			names = append(names, record.Name)
+		}
+		if strings.Join(names, " ") != strings.Join(tt.wantNames, " ") || page.skipped != tt.wantSkipped {
+			t.Errorf("%s: got %q with %d skipped, want %q with %d", tt.name, names, page.skipped, tt.wantNames, tt.wantSkipped)
+		}
+	}
+}
+
+func TestParseCTDataPageInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		pageInfo   string
+		wantToken  string
+		wantNumber int
+		wantTotal  int
+	}{
+		{"full", `[null,"tok",null,2,5]`, "tok", 2, 5},
+		{"no position", `[null,"tok"]`, "tok", 0, 0},
+	}
+	for _, tt := range tests {
+		body := `[["https.ct.cdsr",[[null,"www.example.com","R3",1,2]],[],` + tt.pageInfo + `]]`
+		page, err := parseCTData([]byte(body), false)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if page.token != tt.wantToken || page.number != tt.wantNumber || page.total != tt.wantTotal {
+			t.Errorf("%s: got token %q, page %d of %d, want %q, %d of %d", tt.name, page.token, page.number, page.total, tt.wantToken, tt.wantNumber, tt.wantTotal)
+		}
+	}
+}
+
+func TestGoogleSourcePageFallback(t *testing.T) {
+	// without page numbers in the responses, pages are counted
+	google := newFakeGoogle(t, map[string][]string{
+		"example.com": {ctPageJSON("tok2", "a.example.com")},
+		"tok2":        {ctPageJSON("", "b.example.com")},
+	})
+	records, err := google.source(t).Scan(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Page != 1 || records[1].Page != 2 {
+		t.Errorf("got %+v, want a.example.com on page 1 and b.example.com on page 2", records)
+	}
+}
@@ -0,0 +1,113 @@
+package ctscan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultHTTPProbeTimeout bounds each request of a new HTTPProber.
+const DefaultHTTPProbeTimeout = 5 * time.Second
+
+// HTTPProber checks whether resolved names serve HTTPS by requesting
+// https://name/ and recording the response's status code and Server header.
+// Redirects aren't followed, so they're reported as they are.
+type HTTPProber struct {
+	// Timeout bounds each request, including reading the headers.
+	Timeout time.Duration
+	// Workers is how many names are probed at once. Values below one probe
+	// one at a time.
+	Workers int
+	// Log receives progress messages. It may be nil.
+	Log *Logger
+
+	client *http.Client
+}
+
+// NewHTTPProber returns an HTTPProber that makes requests with a copy of
+// client that doesn't follow redirects. Every name is a different host, so
+// client's transport might as well not keep idle connections.
+func NewHTTPProber(client *http.Client) *HTTPProber {
+	c := *client
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &HTTPProber{
+		Timeout: DefaultHTTPProbeTimeout,
+		Workers: 10,
+		client:  &c,
+	}
+}
+
+// Enrich reads records from in, probes the names that resolved to at least
+// one address, and sends them to out. Records may come out in a different
+// order than they went in. A failed probe is recorded in the record's
+// HTTPError and doesn't stop the stream. It returns when in is closed, or
+// with an error when ctx is done.
+func (p *HTTPProber) Enrich(ctx context.Context, in <-chan Record, out chan<- Record) error {
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range in {
+				if ctx.Err() != nil {
+					return
+				}
+				if len(record.Addrs) > 0 && IsResolvable(record.Name) {
+					p.probe(ctx, &record)
+				}
+				out <- record
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// probe requests a record's name, first with HEAD and, if the server doesn't
+// allow that, with GET.
+func (p *HTTPProber) probe(ctx context.Context, record *Record) {
+	resp, err := p.request(ctx, http.MethodHead, record.Name)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, err = p.request(ctx, http.MethodGet, record.Name)
+	}
+	if err != nil {
+		p.Log.Debugf("probing %s: %v", record.Name, err)
+		record.HTTPError = err.Error()
+		return
+	}
+	record.HTTPStatus = resp.StatusCode
+	record.HTTPServer = resp.Header.Get("Server")
+}
+
+// request sends a single request to https://name/, discarding the body.
+func (p *HTTPProber) request(ctx context.Context, method, name string) (*http.Response, error) {
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+name+"/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	p.Log.Debugf("%s https://%s/", method, name)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// only the headers are wanted, but a little of the body is read so the
+	// connection closes cleanly
+	io.CopyN(ioutil.Discard, resp.Body, 4096)
+	resp.Body.Close()
+	return resp, nil
+}
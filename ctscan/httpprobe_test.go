@@ -0,0 +1,67 @@
+package ctscan
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPProberClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "test/"+r.Method)
+		switch r.Host {
+		case "redirect.example.com":
+			http.Redirect(w, r, "https://elsewhere.example.com/", http.StatusFound)
+		case "get-only.example.com":
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		}
+	}))
+	defer server.Close()
+	// the server's client trusts its certificate; every name is sent to it
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	client := &http.Client{Transport: transport}
+	prober := NewHTTPProber(client)
+	if client.CheckRedirect != nil {
+		t.Error("NewHTTPProber changed the client it was given")
+	}
+
+	tests := []struct {
+		name       string
+		addrs      []string
+		wantStatus int
+		wantServer string
+	}{
+		{"www.example.com", []string{"192.0.2.1"}, http.StatusOK, "test/HEAD"},
+		{"redirect.example.com", []string{"192.0.2.1"}, http.StatusFound, "test/HEAD"},
+		{"get-only.example.com", []string{"192.0.2.1"}, http.StatusOK, "test/GET"},
+		{"unresolved.example.com", nil, 0, ""},
+	}
+	in := make(chan Record, len(tests))
+	out := make(chan Record, len(tests))
+	for _, tt := range tests {
+		in <- Record{Name: tt.name, Addrs: tt.addrs}
+	}
+	close(in)
+	if err := prober.Enrich(context.Background(), in, out); err != nil {
+		t.Fatal(err)
+	}
+	close(out)
+	got := map[string]Record{}
+	for record := range out {
+		got[record.Name] = record
+	}
+	for _, tt := range tests {
+		record := got[tt.name]
+		if record.HTTPStatus != tt.wantStatus || record.HTTPServer != tt.wantServer || record.HTTPError != "" {
+			t.Errorf("%s: got %d %q %q, want %d %q", tt.name, record.HTTPStatus, record.HTTPServer, record.HTTPError, tt.wantStatus, tt.wantServer)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package ctscan
+
+import "net"
+
+// reservedNets are address ranges that aren't reachable on the public
+// internet, beyond those net.IP has methods for.
+var reservedNets = mustParseCIDRs(
+	"0.0.0.0/8",          // "this" network
+	"10.0.0.0/8",         // private
+	"100.64.0.0/10",      // carrier-grade NAT
+	"172.16.0.0/12",      // private
+	"192.0.0.0/24",       // IETF protocol assignments
+	"192.0.2.0/24",       // documentation
+	"192.168.0.0/16",     // private
+	"198.18.0.0/15",      // benchmarking
+	"198.51.100.0/24",    // documentation
+	"203.0.113.0/24",     // documentation
+	"240.0.0.0/4",        // reserved
+	"255.255.255.255/32", // broadcast
+	"2001:db8::/32",      // documentation
+	"fc00::/7",           // unique local
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// IsPublic reports whether an address is publicly routable: not private,
+// loopback, link-local, multicast, or otherwise reserved.
+func IsPublic(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package ctscan
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseDN splits a distinguished name like "C=US, O=Let's Encrypt, CN=R3"
+// into its attributes, keyed by type in upper case. It follows RFC 4514
+// loosely: values can be quoted or escape special characters with a backslash
+// or a hex pair, like "O=Example\, Inc.", and each attribute of a
+// multi-valued part like "OU=Web+CN=R3" is kept. When a type appears more
+// than once, the first value is kept. Parts without a type are ignored.
+func parseDN(dn string) map[string]string {
+	attrs := map[string]string{}
+	for _, part := range splitDN(dn) {
+		i := strings.Index(part, "=")
+		if i < 0 {
+			continue
+		}
+		typ := strings.ToUpper(strings.TrimSpace(part[:i]))
+		if _, present := attrs[typ]; typ == "" || present {
+			continue
+		}
+		attrs[typ] = dnValue(strings.TrimSpace(part[i+1:]))
+	}
+	return attrs
+}
+
+// splitDN splits a distinguished name into its type and value pairs at the
+// commas, semicolons, and plus signs that aren't escaped or quoted. Escapes
+// and quotes are left in place.
+func splitDN(dn string) []string {
+	var parts []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(dn); i++ {
+		switch c := dn[i]; {
+		case c == '\\':
+			// skip whatever is escaped
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && (c == ',' || c == ';' || c == '+'):
+			parts = append(parts, dn[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, dn[start:])
+}
+
+// dnValue removes the quotes and escapes from an attribute value. A
+// backslash at the very end is kept as it is.
+func dnValue(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+	if !strings.Contains(v, "\\") {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch {
+		case v[i] != '\\' || i+1 == len(v):
+			b.WriteByte(v[i])
+		case i+2 < len(v) && isHex(v[i+1]) && isHex(v[i+2]):
+			n, _ := strconv.ParseUint(v[i+1:i+3], 16, 8)
+			b.WriteByte(byte(n))
+			i += 2
+		default:
+			i++
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
+}
+
+// isHex reports whether c is a hexadecimal digit.
+func isHex(c byte) bool {
+	return strings.IndexByte("0123456789abcdefABCDEF", c) >= 0
+}
+
+// setIssuer fills in a record's issuer organization and common name from the
+// issuer's distinguished name. With no distinguished name, the raw issuer
+// string stands in as the common name.
+func setIssuer(record *Record, dn string) {
+	if dn == "" {
+		record.IssuerCN = record.Issuer
+		return
+	}
+	attrs := parseDN(dn)
+	record.IssuerOrg = attrs["O"]
+	record.IssuerCN = attrs["CN"]
+	if record.IssuerCN == "" {
+		record.IssuerCN = record.Issuer
+	}
+}
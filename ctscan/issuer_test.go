@@ -0,0 +1,43 @@
+package ctscan
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDN(t *testing.T) {
+	tests := []struct {
+		dn   string
+		want map[string]string
+	}{
+		{"C=US, O=Let's Encrypt, CN=R3", map[string]string{"C": "US", "O": "Let's Encrypt", "CN": "R3"}},
+		{`O=Example\, Inc., CN=Example CA`, map[string]string{"O": "Example, Inc.", "CN": "Example CA"}},
+		{`O="Example; Inc. + Co", CN=CA`, map[string]string{"O": "Example; Inc. + Co", "CN": "CA"}},
+		{`CN=Caf\C3\A9 CA`, map[string]string{"CN": "Café CA"}},
+		{"OU=Web+CN=R3, O=Example", map[string]string{"OU": "Web", "CN": "R3", "O": "Example"}},
+		// the first of a repeated attribute is kept
+		{"OU=First, OU=Second, CN=R3", map[string]string{"OU": "First", "CN": "R3"}},
+	}
+	for _, tt := range tests {
+		if got := parseDN(tt.dn); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDN(%q) = %q, want %q", tt.dn, got, tt.want)
+		}
+	}
+}
+
+func TestDNValue(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`"in \"quotes\""`, `in "quotes"`},
+		{`\41\42C`, "ABC"},
+		// a backslash without two hex digits escapes the next character
+		{`\zz`, "zz"},
+		{`end\`, `end\`},
+	}
+	for _, tt := range tests {
+		if got := dnValue(tt.in); got != tt.want {
+			t.Errorf("dnValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package ctscan
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// A Level is how much a Logger writes. Each level includes the ones before
+// it.
+type Level int
+
+// Log levels, from least to most verbose.
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts a level name (error, warn, info, or debug) to a Level.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// A Logger writes leveled log messages. A nil *Logger is valid and discards
+// everything, so logging is off unless a Logger is provided.
+type Logger struct {
+	level Level
+	l     *log.Logger
+}
+
+// NewLogger returns a Logger writing messages at level or below to w.
+func NewLogger(w io.Writer, level Level) *Logger {
+	return &Logger{
+		level: level,
+		l:     log.New(w, "", log.LstdFlags),
+	}
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if l == nil || level > l.level {
+		return
+	}
+	l.l.Print(strings.ToUpper(level.String()), " ", fmt.Sprintf(format, args...))
+}
+
+// Errorf logs a message at LevelError.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+// Warnf logs a message at LevelWarn.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Infof logs a message at LevelInfo.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Debugf logs a message at LevelDebug.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
@@ -0,0 +1,373 @@
+package ctscan
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Output is where finished Records end up. Implement it to send records
+// somewhere other than the built-in formats.
+type Output interface {
+	// Write outputs a record. It may be buffered until Flush.
+	Write(Record) error
+	// Flush sends any buffered records on to their destination.
+	Flush() error
+}
+
+// WriteAll writes every record from in to out until in is closed, then
+// flushes out. It stops at the first error.
+func WriteAll(in <-chan Record, out Output) error {
+	for record := range in {
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// A Column extracts one CSV field from a record, for a row about addr.
+type Column func(record Record, addr string) string
+
+// Columns are the fields a CSVOutput can write, by name. The JSON outputs
+// can be limited to the same fields.
+var Columns = map[string]Column{
+	"source":  func(r Record, _ string) string { return r.From },
+	"name":    func(r Record, _ string) string { return r.Name },
+	"probe":   func(r Record, _ string) string { return r.Probe },
+	"address": func(_ Record, addr string) string { return addr },
+	"error": func(r Record, _ string) string {
+		if r.Err != nil {
+			return r.Err.Error()
+		}
+		if r.PrivateOnly {
+			return "only private addresses"
+		}
+		if r.Skipped {
+			return "skipped by filter"
+		}
+		return ""
+	},
+	"status":     func(r Record, _ string) string { return string(r.Status()) },
+	"issuer":     func(r Record, _ string) string { return r.Issuer },
+	"issuer_org": func(r Record, _ string) string { return r.IssuerOrg },
+	"issuer_cn":  func(r Record, _ string) string { return r.IssuerCN },
+	"not_before": func(r Record, _ string) string { return formatMillis(r.NotBeforeTime) },
+	"not_after":  func(r Record, _ string) string { return formatMillis(r.NotAfterTime) },
+	"first_seen": func(r Record, _ string) string { return formatMillis(r.FirstSeen) },
+	"last_seen":  func(r Record, _ string) string { return formatMillis(r.LastSeen) },
+	"days_until_expiry": func(r Record, _ string) string {
+		if days, ok := r.DaysUntilExpiry(time.Now()); ok {
+			return strconv.Itoa(days)
+		}
+		return ""
+	},
+	"lifetime_days": func(r Record, _ string) string {
+		if days, ok := r.LifetimeDays(); ok {
+			return strconv.Itoa(days)
+		}
+		return ""
+	},
+	"cert_count": func(r Record, _ string) string {
+		if r.CertCount == 0 {
+			return ""
+		}
+		return strconv.Itoa(r.CertCount)
+	},
+	"page": func(r Record, _ string) string {
+		if r.Page == 0 {
+			return ""
+		}
+		return strconv.Itoa(r.Page)
+	},
+	"serial":      func(r Record, _ string) string { return r.SerialNumber },
+	"fingerprint": func(r Record, _ string) string { return r.Fingerprint },
+	"cname":       func(r Record, _ string) string { return r.CNAME },
+	"mx":          func(r Record, _ string) string { return strings.Join(r.MX, " ") },
+	"txt":         func(r Record, _ string) string { return strings.Join(r.TXT, " | ") },
+	"ptr":         func(r Record, addr string) string { return strings.Join(r.PTRs[addr], " ") },
+	"asn": func(r Record, addr string) string {
+		if asn, ok := r.ASNs[addr]; ok {
+			return strconv.FormatUint(uint64(asn.Number), 10)
+		}
+		return ""
+	},
+	"asn_org":    func(r Record, addr string) string { return r.ASNs[addr].Org },
+	"registrar":  func(r Record, _ string) string { return r.Registrar },
+	"registered": func(r Record, _ string) string { return formatMillis(r.Registered) },
+	"rdap_error": func(r Record, _ string) string { return r.RDAPError },
+	"raw":        func(r Record, _ string) string { return r.Raw },
+	"http_status": func(r Record, _ string) string {
+		if r.HTTPStatus == 0 {
+			return ""
+		}
+		return strconv.Itoa(r.HTTPStatus)
+	},
+	"http_server": func(r Record, _ string) string { return r.HTTPServer },
+	"http_error":  func(r Record, _ string) string { return r.HTTPError },
+}
+
+// ParseColumns splits a comma-separated list of column names, checking that
+// each is in Columns.
+func ParseColumns(spec string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if _, known := Columns[name]; !known {
+			return nil, fmt.Errorf("unknown column %q, expected one of %s", name, strings.Join(columnNames(), ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// columnNames returns the known column names in sorted order.
+func columnNames() []string {
+	return sortedKeys(Columns)
+}
+
+// CSVOutput writes records as CSV rows, one per resolved address. A record
+// without addresses still gets a row.
+type CSVOutput struct {
+	columns []string
+	w       *csv.Writer
+}
+
+// NewCSVOutput returns a CSVOutput that writes the named Columns to w, in
+// order.
+func NewCSVOutput(w io.Writer, columns []string) *CSVOutput {
+	return &CSVOutput{
+		columns: columns,
+		w:       csv.NewWriter(w),
+	}
+}
+
+// Write writes a record's rows.
+func (c *CSVOutput) Write(record Record) error {
+	if len(record.Addrs) == 0 {
+		return c.w.Write(c.row(record, ""))
+	}
+	for _, addr := range record.Addrs {
+		if err := c.w.Write(c.row(record, addr)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// row builds the fields for a row about addr.
+func (c *CSVOutput) row(record Record, addr string) []string {
+	fields := make([]string, len(c.columns))
+	for i, name := range c.columns {
+		fields[i] = Columns[name](record, addr)
+	}
+	return fields
+}
+
+// Flush writes any buffered rows.
+func (c *CSVOutput) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// EdgesOutput writes records as an edge list for graph tools: two-column CSV
+// rows linking each source domain to the names found for it, and each name
+// to its addresses. Each edge is only written once.
+type EdgesOutput struct {
+	w    *csv.Writer
+	seen map[[2]string]struct{}
+}
+
+// NewEdgesOutput returns an EdgesOutput that writes to w.
+func NewEdgesOutput(w io.Writer) *EdgesOutput {
+	return &EdgesOutput{
+		w:    csv.NewWriter(w),
+		seen: map[[2]string]struct{}{},
+	}
+}
+
+// Write writes the edges of a record that haven't been written before.
+func (e *EdgesOutput) Write(record Record) error {
+	if record.Name == "" {
+		// a failed scan, there's nothing to link
+		return nil
+	}
+	if err := e.edge(record.From, record.Name); err != nil {
+		return err
+	}
+	for _, addr := range record.Addrs {
+		if err := e.edge(record.Name, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// edge writes a row linking from to to, unless it's already been written.
+func (e *EdgesOutput) edge(from, to string) error {
+	key := [2]string{from, to}
+	if _, present := e.seen[key]; present {
+		return nil
+	}
+	e.seen[key] = struct{}{}
+	return e.w.Write(key[:])
+}
+
+// Flush writes any buffered rows.
+func (e *EdgesOutput) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonKeys maps the Columns whose JSON field is named differently to that
+// field. Per-address columns share their record's map of addresses.
+var jsonKeys = map[string]string{
+	"address": "addresses",
+	"ptr":     "ptrs",
+	"asn":     "asns",
+	"asn_org": "asns",
+}
+
+// marshalColumns encodes a record as a JSON object holding just the fields
+// for the named Columns, in order. Empty fields are left out, as they are
+// from the whole record.
+func marshalColumns(record Record, columns []string) ([]byte, error) {
+	b, err := json.Marshal(record)
+	if err != nil || len(columns) == 0 {
+		return b, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	written := map[string]bool{}
+	for _, name := range columns {
+		key := name
+		if k, ok := jsonKeys[name]; ok {
+			key = k
+		}
+		value, ok := fields[key]
+		if !ok || written[key] {
+			continue
+		}
+		written[key] = true
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// JSONLOutput writes each record as a JSON object on a line of its own.
+type JSONLOutput struct {
+	// Columns, if set, limits each object to the fields for the named
+	// Columns, in order. Otherwise every field is written.
+	Columns []string
+
+	w io.Writer
+}
+
+// NewJSONLOutput returns a JSONLOutput that writes to w.
+func NewJSONLOutput(w io.Writer) *JSONLOutput {
+	return &JSONLOutput{w: w}
+}
+
+// Write writes a record's line.
+func (j *JSONLOutput) Write(record Record) error {
+	b, err := marshalColumns(record, j.Columns)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(append(b, '\n'))
+	return err
+}
+
+// Flush does nothing, since records aren't buffered.
+func (j *JSONLOutput) Flush() error {
+	return nil
+}
+
+// JSONOutput writes records as the elements of a single JSON array. Elements
+// are written as they come, so the array isn't held in memory; Close must be
+// called to end it.
+type JSONOutput struct {
+	// Columns, if set, limits each element to the fields for the named
+	// Columns, in order. Otherwise every field is written.
+	Columns []string
+
+	w      *bufio.Writer
+	indent string
+	count  int
+}
+
+// NewJSONOutput returns a JSONOutput that writes to w. If pretty is set, the
+// objects are indented.
+func NewJSONOutput(w io.Writer, pretty bool) *JSONOutput {
+	j := &JSONOutput{w: bufio.NewWriter(w)}
+	if pretty {
+		j.indent = "  "
+	}
+	return j
+}
+
+// Write writes a record as the next array element.
+func (j *JSONOutput) Write(record Record) error {
+	b, err := marshalColumns(record, j.Columns)
+	if err != nil {
+		return err
+	}
+	if j.indent != "" {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, b, j.indent, j.indent); err != nil {
+			return err
+		}
+		b = buf.Bytes()
+	}
+	if j.count == 0 {
+		j.w.WriteString("[\n")
+	} else {
+		j.w.WriteString(",\n")
+	}
+	j.count++
+	j.w.WriteString(j.indent)
+	_, err = j.w.Write(b)
+	return err
+}
+
+// Flush writes any buffered elements.
+func (j *JSONOutput) Flush() error {
+	return j.w.Flush()
+}
+
+// Close ends the array and flushes it. It doesn't close the underlying
+// writer.
+func (j *JSONOutput) Close() error {
+	if j.count == 0 {
+		j.w.WriteString("[]\n")
+	} else {
+		j.w.WriteString("\n]\n")
+	}
+	return j.w.Flush()
+}
+
+// formatMillis formats a time in milliseconds since the epoch as RFC 3339 in
+// UTC. Zero, meaning unknown, is left empty.
+func formatMillis(ms int64) string {
+	if ms == 0 {
+		return ""
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,114 @@
+package ctscan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCSVOutputRows(t *testing.T) {
+	tests := []struct {
+		record Record
+		want   string
+	}{
+		{Record{From: "example.com", Name: "a.example.com", Addrs: []string{"192.0.2.1", "192.0.2.2"}},
+			"example.com,a.example.com,192.0.2.1,\nexample.com,a.example.com,192.0.2.2,\n"},
+		{Record{From: "example.com", Name: "b.example.com", Err: errors.New("no such host")},
+			"example.com,b.example.com,,no such host\n"},
+		{Record{From: "example.com", Name: "*.example.com"}, "example.com,*.example.com,,\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		out := NewCSVOutput(&buf, []string{"source", "name", "address", "error"})
+		if err := out.Write(tt.record); err != nil {
+			t.Fatal(err)
+		}
+		if err := out.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.record.Name, got, tt.want)
+		}
+	}
+}
+
+func TestCSVOutputOtherFamily(t *testing.T) {
+	// resolving only IPv4, a name with only IPv6 addresses still gets its
+	// row, with the address left empty
+	r := newFakeDNS(t, map[string][]string{"v6only.example.test": {"2001:db8::1"}}).resolver()
+	r.Network = "ip4"
+	in := make(chan Record, 1)
+	out := make(chan Record, 1)
+	in <- Record{From: "example.test", Name: "v6only.example.test"}
+	close(in)
+	if err := r.Resolve(context.Background(), in, out); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	csv := NewCSVOutput(&buf, []string{"name", "address", "error"})
+	if err := csv.Write(<-out); err != nil {
+		t.Fatal(err)
+	}
+	if err := csv.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "v6only.example.test,,\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJSONLOutputColumns(t *testing.T) {
+	record := Record{
+		From:   "example.com",
+		Name:   "a.example.com",
+		Issuer: "Example CA",
+		Addrs:  []string{"192.0.2.1"},
+		ASNs:   map[string]ASN{"192.0.2.1": {Number: 64496, Org: "Example"}},
+	}
+	tests := []struct {
+		columns []string
+		want    string
+	}{
+		{[]string{"name", "address"}, `{"name":"a.example.com","addresses":["192.0.2.1"]}`},
+		{[]string{"issuer", "source", "status"}, `{"issuer":"Example CA","source":"example.com","status":"ok"}`},
+		{[]string{"asn", "asn_org", "name"}, `{"asns":{"192.0.2.1":{"number":64496,"org":"Example"}},"name":"a.example.com"}`},
+		{[]string{"name", "error", "cname"}, `{"name":"a.example.com"}`},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		out := NewJSONLOutput(&buf)
+		out.Columns = tt.columns
+		if err := out.Write(record); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.want+"\n" {
+			t.Errorf("%q: got %s, want %s", tt.columns, got, tt.want)
+		}
+	}
+}
+
+func TestCSVOutputStatusRows(t *testing.T) {
+	tests := []struct {
+		record Record
+		want   string
+	}{
+		{Record{From: "example.com", Name: "a.example.com", Addrs: []string{"192.0.2.1"}},
+			"example.com,a.example.com,192.0.2.1,,ok\n"},
+		{Record{From: "example.com", Name: "b.example.com", Err: errors.New("no such host")},
+			"example.com,b.example.com,,no such host,dns_error\n"},
+		{Record{From: "example.com", Err: errors.New("non-200 response 500")},
+			"example.com,,,non-200 response 500,scan_error\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		out := NewCSVOutput(&buf, []string{"source", "name", "address", "error", "status"})
+		if err := out.Write(tt.record); err != nil {
+			t.Fatal(err)
+		}
+		out.Flush()
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.record, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package ctscan
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// maxProtobufRecord bounds the length of a record a ProtobufReader will read,
+// so a corrupt length can't exhaust memory.
+const maxProtobufRecord = 64 << 20
+
+// ProtobufOutput writes records as a stream of Record messages, as defined in
+// record.proto, each preceded by its length as a varint.
+type ProtobufOutput struct {
+	w *bufio.Writer
+}
+
+// NewProtobufOutput returns a ProtobufOutput that writes to w.
+func NewProtobufOutput(w io.Writer) *ProtobufOutput {
+	return &ProtobufOutput{w: bufio.NewWriter(w)}
+}
+
+// Write writes a record's message.
+func (p *ProtobufOutput) Write(record Record) error {
+	b := marshalProtobuf(record)
+	var length []byte
+	length = appendUvarint(length, uint64(len(b)))
+	if _, err := p.w.Write(length); err != nil {
+		return err
+	}
+	_, err := p.w.Write(b)
+	return err
+}
+
+// Flush writes any buffered messages.
+func (p *ProtobufOutput) Flush() error {
+	return p.w.Flush()
+}
+
+// ProtobufReader reads the records written by a ProtobufOutput.
+type ProtobufReader struct {
+	r *bufio.Reader
+}
+
+// NewProtobufReader returns a ProtobufReader that reads from r.
+func NewProtobufReader(r io.Reader) *ProtobufReader {
+	return &ProtobufReader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next record. It returns io.EOF when the stream ends
+// cleanly between records.
+func (p *ProtobufReader) Read() (Record, error) {
+	length, err := binary.ReadUvarint(p.r)
+	if err != nil {
+		return Record{}, err
+	}
+	if length > maxProtobufRecord {
+		return Record{}, fmt.Errorf("record length %d is too long", length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(p.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, err
+	}
+	return unmarshalProtobuf(b)
+}
+
+// marshalProtobuf encodes a record as a Record message. Fields with zero
+// values are left out, as proto3 does.
+func marshalProtobuf(r Record) []byte {
+	var b protoBuilder
+	b.string(1, r.From)
+	b.string(2, r.Name)
+	b.string(3, r.Probe)
+	b.string(4, r.Issuer)
+	b.string(5, r.IssuerOrg)
+	b.string(6, r.IssuerCN)
+	b.varint(7, uint64(r.NotBeforeTime))
+	b.varint(8, uint64(r.NotAfterTime))
+	b.varint(9, uint64(r.CertCount))
+	b.string(10, r.SerialNumber)
+	b.string(11, r.Fingerprint)
+	b.string(12, r.CNAME)
+	b.strings(13, r.MX)
+	b.strings(14, r.TXT)
+	b.strings(15, r.Addrs)
+	if r.PrivateOnly {
+		b.varint(16, 1)
+	}
+	for _, addr := range sortedKeys(r.PTRs) {
+		var names, entry protoBuilder
+		names.strings(1, r.PTRs[addr])
+		entry.string(1, addr)
+		entry.message(2, names)
+		b.message(17, entry)
+	}
+	for _, addr := range sortedKeys(r.ASNs) {
+		var asn, entry protoBuilder
+		asn.varint(1, uint64(r.ASNs[addr].Number))
+		asn.string(2, r.ASNs[addr].Org)
+		entry.string(1, addr)
+		entry.message(2, asn)
+		b.message(18, entry)
+	}
+	b.string(19, string(r.Status()))
+	if r.Err != nil {
+		b.string(20, r.Err.Error())
+	}
+	b.string(21, r.Registrar)
+	b.varint(22, uint64(r.Registered))
+	b.string(23, r.RDAPError)
+	b.varint(24, uint64(r.Page))
+	if r.Skipped {
+		b.varint(25, 1)
+	}
+	b.string(26, r.Raw)
+	b.varint(27, uint64(r.FirstSeen))
+	b.varint(28, uint64(r.LastSeen))
+	b.varint(29, uint64(r.HTTPStatus))
+	b.string(30, r.HTTPServer)
+	b.string(31, r.HTTPError)
+	return b
+}
+
+// unmarshalProtobuf decodes a Record message. The error, if any, comes back
+// as a plain error with the same message. Unknown fields are skipped.
+func unmarshalProtobuf(b []byte) (Record, error) {
+	var r Record
+	err := eachProtoField(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			r.From = string(data)
+		case 2:
+			r.Name = string(data)
+		case 3:
+			r.Probe = string(data)
+		case 4:
+			r.Issuer = string(data)
+		case 5:
+			r.IssuerOrg = string(data)
+		case 6:
+			r.IssuerCN = string(data)
+		case 7:
+			r.NotBeforeTime = int64(v)
+		case 8:
+			r.NotAfterTime = int64(v)
+		case 9:
+			r.CertCount = int(v)
+		case 10:
+			r.SerialNumber = string(data)
+		case 11:
+			r.Fingerprint = string(data)
+		case 12:
+			r.CNAME = string(data)
+		case 13:
+			r.MX = append(r.MX, string(data))
+		case 14:
+			r.TXT = append(r.TXT, string(data))
+		case 15:
+			r.Addrs = append(r.Addrs, string(data))
+		case 16:
+			r.PrivateOnly = v != 0
+		case 17:
+			addr, value, err := protoMapEntry(data)
+			if err != nil {
+				return err
+			}
+			var names []string
+			err = eachProtoField(value, func(field int, _ uint64, data []byte) error {
+				if field == 1 {
+					names = append(names, string(data))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if r.PTRs == nil {
+				r.PTRs = map[string][]string{}
+			}
+			r.PTRs[addr] = names
+		case 18:
+			addr, value, err := protoMapEntry(data)
+			if err != nil {
+				return err
+			}
+			var asn ASN
+			err = eachProtoField(value, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					asn.Number = uint(v)
+				case 2:
+					asn.Org = string(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if r.ASNs == nil {
+				r.ASNs = map[string]ASN{}
+			}
+			r.ASNs[addr] = asn
+		case 20:
+			r.Err = errors.New(string(data))
+		case 21:
+			r.Registrar = string(data)
+		case 22:
+			r.Registered = int64(v)
+		case 23:
+			r.RDAPError = string(data)
+		case 24:
+			r.Page = int(v)
+		case 25:
+			r.Skipped = v != 0
+		case 26:
+			r.Raw = string(data)
+		case 27:
+			r.FirstSeen = int64(v)
+		case 28:
+			r.LastSeen = int64(v)
+		case 29:
+			r.HTTPStatus = int(v)
+		case 30:
+			r.HTTPServer = string(data)
+		case 31:
+			r.HTTPError = string(data)
+		}
+		return nil
+	})
+	return r, err
+}
+
+// protoMapEntry splits a map entry message into its key and the encoded value.
+func protoMapEntry(b []byte) (string, []byte, error) {
+	var key string
+	var value []byte
+	err := eachProtoField(b, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			key = string(data)
+		case 2:
+			value = data
+		}
+		return nil
+	})
+	return key, value, err
+}
+
+// eachProtoField calls fn with each field of an encoded message: its number
+// and its value, either as a varint or, for length-delimited fields, as
+// bytes. Fixed-width fields aren't used by Record and are skipped.
+func eachProtoField(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("malformed field key")
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("malformed varint in field %d", field)
+			}
+			b = b[n:]
+			if err := fn(field, v, nil); err != nil {
+				return err
+			}
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return fmt.Errorf("malformed length in field %d", field)
+			}
+			data := b[n : n+int(length)]
+			b = b[n+int(length):]
+			if err := fn(field, 0, data); err != nil {
+				return err
+			}
+		case wireFixed64:
+			if len(b) < 8 {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", key&7, field)
+		}
+	}
+	return nil
+}
+
+// protoBuilder accumulates an encoded message.
+type protoBuilder []byte
+
+func (b *protoBuilder) key(field, wireType int) {
+	*b = appendUvarint(*b, uint64(field)<<3|uint64(wireType))
+}
+
+func (b *protoBuilder) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.key(field, wireVarint)
+	*b = appendUvarint(*b, v)
+}
+
+func (b *protoBuilder) bytes(field int, data []byte) {
+	b.key(field, wireBytes)
+	*b = appendUvarint(*b, uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *protoBuilder) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	b.bytes(field, []byte(s))
+}
+
+// strings encodes a repeated string field. Unlike a single string, empty
+// elements are kept so the count stays right.
+func (b *protoBuilder) strings(field int, ss []string) {
+	for _, s := range ss {
+		b.bytes(field, []byte(s))
+	}
+}
+
+func (b *protoBuilder) message(field int, m protoBuilder) {
+	b.bytes(field, m)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// sortedKeys returns the keys of m in order, so encodings and listings are
+// stable.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,132 @@
+package ctscan
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestProtobufRoundTrip(t *testing.T) {
+	records := []Record{
+		{From: "example.com", Err: errors.New("scan failed")},
+		{
+			From:          "example.com",
+			Name:          "www.example.com",
+			Probe:         "probe.example.com",
+			Issuer:        "C=US, O=Example, CN=Example CA",
+			IssuerOrg:     "Example",
+			IssuerCN:      "Example CA",
+			NotBeforeTime: 1600000000000,
+			NotAfterTime:  1700000000000,
+			CertCount:     3,
+			FirstSeen:     1500000000000,
+			LastSeen:      1700000000000,
+			Page:          2,
+			SerialNumber:  "01ab",
+			Fingerprint:   "ffee",
+			CNAME:         "cdn.example.net",
+			MX:            []string{"mx1.example.com", ""},
+			TXT:           []string{"v=spf1 -all"},
+			Addrs:         []string{"192.0.2.1", "2001:db8::1"},
+			PTRs: map[string][]string{
+				"192.0.2.1":   {"a.example.net", "b.example.net"},
+				"2001:db8::1": {"c.example.net"},
+			},
+			ASNs: map[string]ASN{
+				"192.0.2.1":   {Number: 64496, Org: "Example"},
+				"2001:db8::1": {Number: 64497},
+			},
+			Registrar:  "Example Registrar",
+			Registered: 900000000000,
+			RDAPError:  "rate limited",
+			HTTPStatus: 200,
+			HTTPServer: "nginx",
+			HTTPError:  "tls: bad certificate",
+			Raw:        `["x"]`,
+		},
+		{From: "example.com", Name: "skipped.example.com", Skipped: true, PrivateOnly: true},
+		{From: "example.com", Name: "old.example.com", NotBeforeTime: -1000},
+	}
+	var buf bytes.Buffer
+	out := NewProtobufOutput(&buf)
+	for _, record := range records {
+		if err := out.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	in := NewProtobufReader(&buf)
+	for _, want := range records {
+		got, err := in.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got.Err == nil) != (want.Err == nil) || got.Err != nil && got.Err.Error() != want.Err.Error() {
+			t.Errorf("%s: error %v, want %v", want.Name, got.Err, want.Err)
+		}
+		got.Err, want.Err = nil, nil
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	if _, err := in.Read(); err != io.EOF {
+		t.Errorf("reading past the last record: got %v, want io.EOF", err)
+	}
+}
+
+func TestProtobufGolden(t *testing.T) {
+	tests := []struct {
+		record Record
+		want   string
+	}{
+		// source, name, addresses, then status "ok" with a two byte key
+		{Record{From: "a", Name: "b", Addrs: []string{"1"}}, "0e" + "0a0161" + "120162" + "7a0131" + "9a01026f6b"},
+		// map entries come out in address order
+		{
+			Record{ASNs: map[string]ASN{"b": {Number: 2}, "a": {Number: 1}}},
+			"23" + "9201070a016112020801" + "9201070a016212020802" + "9a010c6e6f5f616464726573736573",
+		},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 3; i++ {
+			var buf bytes.Buffer
+			out := NewProtobufOutput(&buf)
+			if err := out.Write(tt.record); err != nil {
+				t.Fatal(err)
+			}
+			out.Flush()
+			if got := hex.EncodeToString(buf.Bytes()); got != tt.want {
+				t.Errorf("%+v: got %s, want %s", tt.record, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestProtobufReaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"empty", "", io.EOF},
+		{"truncated record", "0e0a0161", io.ErrUnexpectedEOF},
+		{"too long", "8080808001", nil},
+		{"malformed field", "02ff", nil},
+	}
+	for _, tt := range tests {
+		b, err := hex.DecodeString(tt.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewProtobufReader(bytes.NewReader(b)).Read()
+		if err == nil || tt.want != nil && err != tt.want {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
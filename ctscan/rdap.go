@@ -0,0 +1,192 @@
+package ctscan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/time/rate"
+)
+
+// DefaultRDAPURL is the BaseURL of a new RDAPClient. It redirects each query
+// to the RDAP server of the domain's registry.
+const DefaultRDAPURL = "https://rdap.org"
+
+// RDAPClient looks up the registration of domains with RDAP, the successor to
+// WHOIS. Results, including failures, are cached by registrable domain, so
+// each is only queried once. It's safe for concurrent use.
+type RDAPClient struct {
+	// BaseURL is the RDAP server, or bootstrap redirector, to query.
+	BaseURL string
+	// Log receives warnings about failed lookups. It may be nil.
+	Log *Logger
+	// Limiter, if set, is waited on before each query. It should be separate
+	// from the CT sources' so neither eats into the other's budget.
+	Limiter *rate.Limiter
+
+	client *http.Client
+	lock   sync.Mutex
+	cache  map[string]*rdapEntry
+}
+
+// rdapEntry is a cached lookup. done is closed once the lookup has finished,
+// so concurrent lookups of the same domain wait for the first.
+type rdapEntry struct {
+	done       chan struct{}
+	registrar  string
+	registered int64
+	err        error
+}
+
+// NewRDAPClient returns an RDAPClient that makes requests with client.
+func NewRDAPClient(client *http.Client) *RDAPClient {
+	return &RDAPClient{
+		BaseURL: DefaultRDAPURL,
+		client:  client,
+		cache:   map[string]*rdapEntry{},
+	}
+}
+
+// Enrich reads records from in, sets their registration fields from the
+// registrable domain of each name, and sends them to out. A failed lookup is
+// recorded in the record's RDAPError and doesn't stop the stream. It returns
+// when in is closed, or with an error when ctx is done.
+func (c *RDAPClient) Enrich(ctx context.Context, in <-chan Record, out chan<- Record) error {
+	for record := range in {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		apex, err := publicsuffix.EffectiveTLDPlusOne(normalizeDomain(record.Name))
+		if err == nil && IsResolvable(apex) {
+			entry := c.lookup(ctx, apex)
+			record.Registrar = entry.registrar
+			record.Registered = entry.registered
+			if entry.err != nil {
+				record.RDAPError = entry.err.Error()
+			}
+		}
+		out <- record
+	}
+	return nil
+}
+
+// lookup returns the registration of a registrable domain, from the cache if
+// it's been looked up before.
+func (c *RDAPClient) lookup(ctx context.Context, domain string) *rdapEntry {
+	c.lock.Lock()
+	entry, present := c.cache[domain]
+	if !present {
+		entry = &rdapEntry{done: make(chan struct{})}
+		c.cache[domain] = entry
+	}
+	c.lock.Unlock()
+	if present {
+		<-entry.done
+		return entry
+	}
+
+	entry.registrar, entry.registered, entry.err = c.query(ctx, domain)
+	if entry.err != nil {
+		c.Log.Warnf("rdap %s: %v", domain, entry.err)
+	}
+	close(entry.done)
+	return entry
+}
+
+// rdapDomain is the part of an RDAP domain response that's used.
+type rdapDomain struct {
+	Events []struct {
+		Action string `json:"eventAction"`
+		Date   string `json:"eventDate"`
+	} `json:"events"`
+	Entities []struct {
+		Roles []string          `json:"roles"`
+		VCard []json.RawMessage `json:"vcardArray"`
+	} `json:"entities"`
+}
+
+// query asks the RDAP server for a domain's registrar and when it was
+// registered, in milliseconds since the epoch.
+func (c *RDAPClient) query(ctx context.Context, domain string) (string, int64, error) {
+	u, err := buildURL(c.BaseURL, "/domain/"+domain, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/rdap+json, application/json")
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return "", 0, fmt.Errorf("waiting for rate limit: %w", err)
+		}
+	}
+	c.Log.Debugf("GET %s", u)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", 0, fmt.Errorf("not found")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", 0, fmt.Errorf("non-200 response %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	var d rdapDomain
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return "", 0, fmt.Errorf("parsing JSON: %w", err)
+	}
+	var registered int64
+	for _, event := range d.Events {
+		if event.Action != "registration" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, event.Date); err == nil {
+			registered = t.UnixNano() / int64(time.Millisecond)
+		}
+	}
+	var registrar string
+	for _, entity := range d.Entities {
+		if hasRole(entity.Roles, "registrar") && len(entity.VCard) == 2 {
+			registrar = vcardName(entity.VCard[1])
+		}
+	}
+	return registrar, registered, nil
+}
+
+// hasRole reports whether role is among roles.
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// vcardName returns the formatted name from the properties of a jCard, which
+// are arrays of name, parameters, type, and value.
+func vcardName(properties json.RawMessage) string {
+	var props [][]interface{}
+	if err := json.Unmarshal(properties, &props); err != nil {
+		return ""
+	}
+	for _, prop := range props {
+		if len(prop) < 4 || prop[0] != "fn" {
+			continue
+		}
+		if name, ok := prop[3].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package ctscan
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// A Record captures information about a domain from certificate transparency
+// and subsequent DNS resolution
+type Record struct {
+	From          string              `json:"source"`
+	Name          string              `json:"name"`
+	Probe         string              `json:"probe,omitempty"`
+	Issuer        string              `json:"issuer,omitempty"`
+	IssuerOrg     string              `json:"issuer_org,omitempty"`
+	IssuerCN      string              `json:"issuer_cn,omitempty"`
+	NotBeforeTime int64               `json:"not_before,omitempty"`
+	NotAfterTime  int64               `json:"not_after,omitempty"`
+	CertCount     int                 `json:"cert_count,omitempty"`
+	FirstSeen     int64               `json:"first_seen,omitempty"`
+	LastSeen      int64               `json:"last_seen,omitempty"`
+	Page          int                 `json:"page,omitempty"`
+	SerialNumber  string              `json:"serial,omitempty"`
+	Fingerprint   string              `json:"fingerprint,omitempty"`
+	CNAME         string              `json:"cname,omitempty"`
+	MX            []string            `json:"mx,omitempty"`
+	TXT           []string            `json:"txt,omitempty"`
+	Addrs         []string            `json:"addresses,omitempty"`
+	PrivateOnly   bool                `json:"private_only,omitempty"`
+	Skipped       bool                `json:"skipped,omitempty"`
+	PTRs          map[string][]string `json:"ptrs,omitempty"`
+	ASNs          map[string]ASN      `json:"asns,omitempty"`
+	Registrar     string              `json:"registrar,omitempty"`
+	Registered    int64               `json:"registered,omitempty"`
+	RDAPError     string              `json:"rdap_error,omitempty"`
+	HTTPStatus    int                 `json:"http_status,omitempty"`
+	HTTPServer    string              `json:"http_server,omitempty"`
+	HTTPError     string              `json:"http_error,omitempty"`
+	Raw           string              `json:"raw,omitempty"`
+	Err           error               `json:"-"`
+}
+
+// A Status summarizes the outcome for a Record.
+type Status string
+
+// The possible Statuses of a Record.
+const (
+	// StatusOK means the name resolved to at least one address.
+	StatusOK Status = "ok"
+	// StatusNoAddresses means the name has no addresses, or none that were
+	// kept. Names that weren't looked up, like wildcards, have this status
+	// too.
+	StatusNoAddresses Status = "no_addresses"
+	// StatusSkipped means the name wasn't looked up because the Resolver's
+	// Filter left it out.
+	StatusSkipped Status = "skipped"
+	// StatusDNSError means looking the name up failed.
+	StatusDNSError Status = "dns_error"
+	// StatusScanError means scanning the domain in From failed. The Record
+	// has no Name.
+	StatusScanError Status = "scan_error"
+)
+
+// Status returns the status of the record.
+func (r Record) Status() Status {
+	switch {
+	case r.Err != nil && r.Name == "":
+		return StatusScanError
+	case r.Err != nil:
+		return StatusDNSError
+	case r.Skipped:
+		return StatusSkipped
+	case len(r.Addrs) == 0:
+		return StatusNoAddresses
+	}
+	return StatusOK
+}
+
+// day is the length of a day in milliseconds, the units of validity times.
+const day = float64(24 * time.Hour / time.Millisecond)
+
+// DaysUntilExpiry returns the number of whole days from now until the
+// certificate expires, which is negative once it has. It reports false if
+// the expiry time isn't known.
+func (r Record) DaysUntilExpiry(now time.Time) (int, bool) {
+	if r.NotAfterTime == 0 {
+		return 0, false
+	}
+	nowMillis := now.UnixNano() / int64(time.Millisecond)
+	return int(math.Floor(float64(r.NotAfterTime-nowMillis) / day)), true
+}
+
+// LifetimeDays returns how many days the certificate is valid for, to the
+// nearest day. It reports false if either validity time isn't known.
+func (r Record) LifetimeDays() (int, bool) {
+	if r.NotBeforeTime == 0 || r.NotAfterTime == 0 {
+		return 0, false
+	}
+	return int(math.Round(float64(r.NotAfterTime-r.NotBeforeTime) / day)), true
+}
+
+// MarshalJSON encodes a record with its status, its error, if any, as a
+// string, and the day counts computed from its validity times, if they're
+// known.
+func (r Record) MarshalJSON() ([]byte, error) {
+	type record Record
+	out := struct {
+		record
+		DaysUntilExpiry *int   `json:"days_until_expiry,omitempty"`
+		LifetimeDays    *int   `json:"lifetime_days,omitempty"`
+		Status          Status `json:"status"`
+		Error           string `json:"error,omitempty"`
+	}{record: record(r), Status: r.Status()}
+	if days, ok := r.DaysUntilExpiry(time.Now()); ok {
+		out.DaysUntilExpiry = &days
+	}
+	if days, ok := r.LifetimeDays(); ok {
+		out.LifetimeDays = &days
+	}
+	if r.Err != nil {
+		out.Error = r.Err.Error()
+	}
+	return json.Marshal(out)
+}
+
+// issuedSince returns the records whose certificates became valid at or after
+// since, and reports whether any were dropped for being older. A zero since
+// keeps everything, as do unknown validity times.
+func issuedSince(records []Record, since time.Time) ([]Record, bool) {
+	if since.IsZero() {
+		return records, false
+	}
+	cutoff := since.UnixNano() / int64(time.Millisecond)
+	kept := records[:0]
+	older := false
+	for _, record := range records {
+		if record.NotBeforeTime != 0 && record.NotBeforeTime < cutoff {
+			older = true
+			continue
+		}
+		kept = append(kept, record)
+	}
+	return kept, older
+}
@@ -0,0 +1,24 @@
+package ctscan
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRecordStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		record Record
+		want   Status
+	}{
+		{"resolved", Record{Name: "a.example.com", Addrs: []string{"192.0.2.1"}}, StatusOK},
+		{"wildcard", Record{Name: "*.example.com"}, StatusNoAddresses},
+		{"lookup failed", Record{Name: "a.example.com", Err: errors.New("no such host")}, StatusDNSError},
+		{"scan failed", Record{From: "example.com", Err: errors.New("non-200 response")}, StatusScanError},
+	}
+	for _, tt := range tests {
+		if got := tt.record.Status(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
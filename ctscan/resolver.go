@@ -0,0 +1,594 @@
+package ctscan
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDNSTimeout is reported for lookups that didn't finish in time.
+var ErrDNSTimeout = errors.New("dns timeout")
+
+// A Resolver handles concurrent DNS resolution on Records. One resolver can
+// process many records in parallel.
+type Resolver struct {
+	// counters are updated atomically. They come first to keep them 64-bit
+	// aligned.
+	resolvedCount int64
+	cacheHits     int64
+	cacheMisses   int64
+	notFound      int64
+	timeouts      int64
+	otherErrs     int64
+	active        int64
+
+	// Network is the address family to resolve: "ip", "ip4", or "ip6".
+	Network string
+	// DNS performs the lookups.
+	DNS *net.Resolver
+	// Timeout bounds each lookup. Zero leaves it to the DNS resolver.
+	Timeout time.Duration
+	// Retries is how many more times to try an address lookup that failed
+	// with a temporary error, like a timeout or server failure. Lookups that
+	// found the name doesn't exist aren't retried.
+	Retries int
+	// Log receives debug messages about retries. It may be nil.
+	Log *Logger
+	// CacheTTL, if set, caches the results of address lookups for this long,
+	// so names that come up again are answered from memory. Names that
+	// don't exist are cached too, but temporary failures aren't.
+	CacheTTL time.Duration
+	// PTR looks up the reverse DNS names of each resolved address.
+	PTR bool
+	// CNAME looks up the canonical name each name is an alias for.
+	CNAME bool
+	// MX looks up the mail servers for each name.
+	MX bool
+	// TXT looks up the TXT records for each name.
+	TXT bool
+	// PublicOnly drops addresses that aren't publicly routable. Records
+	// left with none are marked PrivateOnly.
+	PublicOnly bool
+	// ASN, if set, is used to look up the autonomous system of each resolved
+	// address.
+	ASN *ASNDB
+	// MaxNames bounds how many names are remembered for skipping repeats.
+	// Past that the least recently seen names are forgotten, and resolved
+	// again if they come up later. Zero means no limit.
+	MaxNames int
+	// WildcardProbe, if set, is a label substituted for the * of wildcard
+	// names so they can be resolved. The name looked up is stored in the
+	// record's Probe field; its Name is left as it was.
+	WildcardProbe string
+	// AllRecords passes along every record, such as one for each certificate
+	// a name appears on, instead of only the first for each name. A name's
+	// lookups are still only done once, and copied to its later records.
+	// MaxNames bounds how many names' lookups are kept for this.
+	AllRecords bool
+	// Filter, if set, chooses which names are looked up. Names it returns
+	// false for are passed through unresolved, marked Skipped.
+	Filter func(name string) bool
+	// OnRecord, if set, is called with each record Resolve sends out, just
+	// before it's sent, so a program can react to records as they're found
+	// without reading the channel itself. Records of failed scans are
+	// included. With Workers set, or with Resolve running in several
+	// goroutines, it may be called concurrently and must be safe for that.
+	// Resolve waits for it to return, so a slow OnRecord slows resolution.
+	OnRecord func(Record)
+	// OnDrop, if set, is called with each record Resolve doesn't send out
+	// because its name was already resolved. Like OnRecord, it may be called
+	// concurrently.
+	OnDrop func(Record)
+	// Workers, if set, has each call to Resolve hand records off to be
+	// resolved in the background, with at most this many being resolved at
+	// once across all calls. A slow lookup then doesn't stop Resolve from
+	// taking more records. Zero resolves each record in the calling
+	// goroutine.
+	Workers int
+
+	resolvedOnce sync.Once
+	resolved     *seenSet
+	cache        *dnsCache
+	semOnce      sync.Once
+	sem          chan struct{}
+	lock         sync.Mutex
+	ptrs         map[string][]string
+	// earlier holds the lookups for the first record of each name, with
+	// AllRecords, and earlierOrder the same, most recently used first. Past
+	// MaxNames the least recently used are forgotten.
+	earlier      map[string]*list.Element
+	earlierOrder *list.List
+}
+
+// A firstLookup is the lookups for the first record of a name, shared with
+// its later records. done is closed once record holds them.
+type firstLookup struct {
+	name   string
+	done   chan struct{}
+	record Record
+}
+
+// NewResolver returns a Resolver that looks up all address families using
+// the system resolver, with no timeout.
+func NewResolver() *Resolver {
+	return &Resolver{
+		Network:      "ip",
+		DNS:          net.DefaultResolver,
+		cache:        newDNSCache(),
+		ptrs:         map[string][]string{},
+		earlier:      map[string]*list.Element{},
+		earlierOrder: list.New(),
+	}
+}
+
+// Resolve loops over a stream of Record structs, performing DNS resolution and
+// streaming out results. It returns when in is closed and every record taken
+// has been sent, or with an error when ctx is done. Names that have already
+// been resolved by this Resolver are skipped, unless AllRecords is set.
+func (r *Resolver) Resolve(ctx context.Context, in <-chan Record, out chan<- Record) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for record := range in {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if record.Name == "" {
+			// a failed scan, there's nothing to resolve
+			r.send(out, record)
+			continue
+		}
+		if !r.AllRecords && !r.resolvedSet().Add(record.Name) {
+			// This domain has already been resolved
+			if r.OnDrop != nil {
+				r.OnDrop(record)
+			}
+			continue
+		}
+		if r.Workers <= 0 {
+			r.send(out, r.resolve(ctx, record))
+			continue
+		}
+
+		// hand the lookups off so a slow one doesn't hold up this loop
+		sem := r.workerSem()
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func(record Record) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r.send(out, r.resolve(ctx, record))
+		}(record)
+	}
+	return nil
+}
+
+// send passes a finished record to OnRecord, if it's set, and then to out.
+func (r *Resolver) send(out chan<- Record, record Record) {
+	if r.OnRecord != nil {
+		r.OnRecord(record)
+	}
+	out <- record
+}
+
+// workerSem returns the semaphore that caps lookups at Workers.
+func (r *Resolver) workerSem() chan struct{} {
+	r.semOnce.Do(func() {
+		r.sem = make(chan struct{}, r.Workers)
+	})
+	return r.sem
+}
+
+// resolvedSet returns the set of names already resolved, creating it bounded
+// by MaxNames on first use.
+func (r *Resolver) resolvedSet() *seenSet {
+	r.resolvedOnce.Do(func() {
+		r.resolved = newSeenSet(r.MaxNames)
+	})
+	return r.resolved
+}
+
+// resolve performs all of the lookups for a record. With AllRecords, they're
+// done for the first record of each name and copied to the rest, which wait
+// for them if they're still underway.
+func (r *Resolver) resolve(ctx context.Context, record Record) Record {
+	if !r.AllRecords {
+		return r.lookupRecord(ctx, record)
+	}
+	first, found := r.firstLookup(record.Name)
+	if found {
+		select {
+		case <-first.done:
+			return withLookups(record, first.record)
+		case <-ctx.Done():
+			record.Err = ctx.Err()
+			return record
+		}
+	}
+	first.record = r.lookupRecord(ctx, record)
+	close(first.done)
+	return first.record
+}
+
+// firstLookup returns the lookups for the first record of name, reporting
+// false if there wasn't one yet, in which case the caller must do them and
+// close done.
+func (r *Resolver) firstLookup(name string) (*firstLookup, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if e, present := r.earlier[name]; present {
+		r.earlierOrder.MoveToFront(e)
+		return e.Value.(*firstLookup), true
+	}
+	first := &firstLookup{name: name, done: make(chan struct{})}
+	r.earlier[name] = r.earlierOrder.PushFront(first)
+	for r.MaxNames > 0 && r.earlierOrder.Len() > r.MaxNames {
+		// records still waiting on it hold their own reference
+		oldest := r.earlierOrder.Back()
+		r.earlierOrder.Remove(oldest)
+		delete(r.earlier, oldest.Value.(*firstLookup).name)
+	}
+	return first, false
+}
+
+// withLookups returns record with the results of looking up its name copied
+// from resolved, a record for the same name.
+func withLookups(record, resolved Record) Record {
+	record.Probe = resolved.Probe
+	record.Addrs = resolved.Addrs
+	record.Err = resolved.Err
+	record.PrivateOnly = resolved.PrivateOnly
+	record.Skipped = resolved.Skipped
+	record.CNAME = resolved.CNAME
+	record.MX = resolved.MX
+	record.TXT = resolved.TXT
+	record.PTRs = resolved.PTRs
+	record.ASNs = resolved.ASNs
+	return record
+}
+
+// lookupRecord performs all of the lookups for a record. Records that can't
+// be looked up, like wildcards that aren't probed, are returned unchanged.
+func (r *Resolver) lookupRecord(ctx context.Context, record Record) Record {
+	name := record.Name
+	if r.WildcardProbe != "" && strings.HasPrefix(name, "*.") {
+		name = r.WildcardProbe + name[1:]
+		record.Probe = name
+	} else if addr := ipLiteral(name, r.Network); addr != nil {
+		// the name is its own address, there's nothing to look up
+		record.Addrs = addr
+		if r.PublicOnly {
+			record.Addrs = publicAddrs(record.Addrs)
+			record.PrivateOnly = len(record.Addrs) == 0
+		}
+		return record
+	} else if !IsResolvable(name) {
+		return record
+	}
+	if r.Filter != nil && !r.Filter(record.Name) {
+		record.Skipped = true
+		return record
+	}
+
+	atomic.AddInt64(&r.active, 1)
+	defer atomic.AddInt64(&r.active, -1)
+	record.Addrs, record.Err = r.lookup(ctx, name)
+	atomic.AddInt64(&r.resolvedCount, 1)
+	switch {
+	case record.Err == nil:
+	case errors.Is(record.Err, ErrDNSTimeout):
+		atomic.AddInt64(&r.timeouts, 1)
+	case IsNotFound(record.Err):
+		atomic.AddInt64(&r.notFound, 1)
+	default:
+		atomic.AddInt64(&r.otherErrs, 1)
+	}
+	if r.PublicOnly && len(record.Addrs) > 0 {
+		record.Addrs = publicAddrs(record.Addrs)
+		record.PrivateOnly = len(record.Addrs) == 0
+	}
+	if r.CNAME {
+		record.CNAME = r.lookupCNAME(ctx, name)
+	}
+	if r.MX {
+		record.MX = r.lookupMX(ctx, name)
+	}
+	if r.TXT {
+		record.TXT = r.lookupTXT(ctx, name)
+	}
+	if r.PTR && len(record.Addrs) > 0 {
+		record.PTRs = r.lookupPTRs(ctx, record.Addrs)
+	}
+	if r.ASN != nil && len(record.Addrs) > 0 {
+		record.ASNs = r.lookupASNs(record.Addrs)
+	}
+	return record
+}
+
+// Resolved returns the number of names the Resolver has looked up.
+func (r *Resolver) Resolved() int64 {
+	return atomic.LoadInt64(&r.resolvedCount)
+}
+
+// CacheStats returns the number of address lookups answered from the cache
+// and the number that had to be sent.
+func (r *Resolver) CacheStats() (hits, misses int64) {
+	return atomic.LoadInt64(&r.cacheHits), atomic.LoadInt64(&r.cacheMisses)
+}
+
+// Errors returns the number of address lookups that failed, by why: the name
+// doesn't exist, the lookup timed out, or anything else.
+func (r *Resolver) Errors() (notFound, timeouts, other int64) {
+	return atomic.LoadInt64(&r.notFound), atomic.LoadInt64(&r.timeouts), atomic.LoadInt64(&r.otherErrs)
+}
+
+// Active returns the number of names being looked up right now.
+func (r *Resolver) Active() int64 {
+	return atomic.LoadInt64(&r.active)
+}
+
+// publicAddrs returns the addresses that are publicly routable.
+func publicAddrs(addrs []string) []string {
+	var public []string
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && IsPublic(ip) {
+			public = append(public, addr)
+		}
+	}
+	return public
+}
+
+// IsResolvable reports whether a name from a certificate can be looked up in
+// DNS. Wildcards, quoted non-DNS subjects, email addresses, URIs and other
+// names with a prefix like "URI:", names with spaces, and IP address literals
+// won't resolve.
+func IsResolvable(name string) bool {
+	switch {
+	case name == "",
+		strings.HasPrefix(name, "*"),
+		strings.HasPrefix(name, `"`),
+		strings.ContainsAny(name, "@: \t"),
+		net.ParseIP(name) != nil:
+		return false
+	}
+	return true
+}
+
+// ipLiteral returns the address a name stands for if it's an IPv4 or IPv6
+// address literal, which may be bracketed, and of the given network family.
+// It returns an empty, non-nil slice for a literal of the other family, and
+// nil for names that aren't literals.
+func ipLiteral(name, network string) []string {
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(name, "["), "]"))
+	if ip == nil {
+		return nil
+	}
+	if (network == "ip4" && ip.To4() == nil) || (network == "ip6" && ip.To4() != nil) {
+		return []string{}
+	}
+	return []string{ip.String()}
+}
+
+// IsNotFound reports whether err is from a DNS lookup that found the name
+// has no records, rather than one that failed for a possibly transient
+// reason like a timeout or server failure.
+func IsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// dnsRetryBackoff is how long to wait before the first retry of a lookup.
+// It doubles for each retry after that.
+const dnsRetryBackoff = 250 * time.Millisecond
+
+// lookup resolves a single name, answering from the cache when it's enabled.
+// Only addresses in the resolver's network family are returned.
+func (r *Resolver) lookup(ctx context.Context, name string) ([]string, error) {
+	if r.CacheTTL <= 0 {
+		return r.lookupRetry(ctx, name)
+	}
+	key := r.Network + " " + strings.ToLower(name)
+	if entry, cached := r.cache.get(key); cached {
+		atomic.AddInt64(&r.cacheHits, 1)
+		return entry.addrs, entry.err
+	}
+	atomic.AddInt64(&r.cacheMisses, 1)
+	addrs, err := r.lookupRetry(ctx, name)
+	if err == nil || IsNotFound(err) {
+		r.cache.put(key, addrs, err, r.CacheTTL)
+	}
+	return addrs, err
+}
+
+// lookupRetry resolves a single name, retrying temporary failures up to the
+// resolver's Retries.
+func (r *Resolver) lookupRetry(ctx context.Context, name string) ([]string, error) {
+	backoff := dnsRetryBackoff
+	for attempt := 1; ; attempt++ {
+		addrs, err := r.lookupOnce(ctx, name)
+		if err == nil || attempt > r.Retries || !isTemporary(err) {
+			if attempt > 1 {
+				r.Log.Debugf("%s: %d lookup attempts", name, attempt)
+			}
+			return addrs, err
+		}
+		if err := sleep(ctx, backoff); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// isTemporary reports whether a lookup error might go away if it's tried
+// again.
+func isTemporary(err error) bool {
+	if errors.Is(err, ErrDNSTimeout) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && !dnsErr.IsNotFound && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+}
+
+// lookupOnce resolves a single name, giving up after the resolver's timeout.
+func (r *Resolver) lookupOnce(ctx context.Context, name string) ([]string, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	// Both families are asked for and then filtered, since asking for only
+	// one fails with "no such host" for a name that just has the other, which
+	// would look like a name that doesn't exist.
+	ips, err := r.DNS.LookupIP(ctx, "ip", name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if ctx.Err() == context.DeadlineExceeded || (errors.As(err, &dnsErr) && dnsErr.IsTimeout) {
+			return nil, ErrDNSTimeout
+		}
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if (r.Network == "ip4" && ip.To4() == nil) || (r.Network == "ip6" && ip.To4() != nil) {
+			continue
+		}
+		addrs = append(addrs, ip.String())
+	}
+	return addrs, nil
+}
+
+// lookupCNAME returns the final target of name's CNAME chain, or an empty
+// string if name isn't an alias or the lookup fails.
+func (r *Resolver) lookupCNAME(ctx context.Context, name string) string {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	cname, err := r.DNS.LookupCNAME(ctx, name)
+	if err != nil {
+		return ""
+	}
+	cname = strings.TrimSuffix(cname, ".")
+	if strings.EqualFold(cname, strings.TrimSuffix(name, ".")) {
+		// names that aren't aliases are their own canonical name
+		return ""
+	}
+	return cname
+}
+
+// lookupMX returns the mail server hosts for name in order of preference,
+// or nil if it has none or the lookup fails.
+func (r *Resolver) lookupMX(ctx context.Context, name string) []string {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	mxs, err := r.DNS.LookupMX(ctx, name)
+	if err != nil {
+		return nil
+	}
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts
+}
+
+// lookupTXT returns the TXT records for name, or nil if it has none or the
+// lookup fails.
+func (r *Resolver) lookupTXT(ctx context.Context, name string) []string {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	txts, err := r.DNS.LookupTXT(ctx, name)
+	if err != nil {
+		return nil
+	}
+	return txts
+}
+
+// maxPTRLookups caps how many of a name's addresses get reverse lookups, so
+// names with huge address sets don't hold up resolution.
+const maxPTRLookups = 8
+
+// lookupPTRs finds the reverse DNS names for addrs, keyed by address. Results
+// are cached since many names share addresses. Failed lookups are left out.
+func (r *Resolver) lookupPTRs(ctx context.Context, addrs []string) map[string][]string {
+	ptrs := map[string][]string{}
+	for i, addr := range addrs {
+		if i == maxPTRLookups {
+			break
+		}
+		r.lock.Lock()
+		names, cached := r.ptrs[addr]
+		r.lock.Unlock()
+		if !cached {
+			lookupCtx, cancel := r.withTimeout(ctx)
+			names, _ = r.DNS.LookupAddr(lookupCtx, addr)
+			cancel()
+			r.lock.Lock()
+			r.ptrs[addr] = names
+			r.lock.Unlock()
+		}
+		if len(names) > 0 {
+			ptrs[addr] = names
+		}
+	}
+	return ptrs
+}
+
+// lookupASNs finds the ASN of each address, keyed by address. Addresses
+// that can't be looked up are left out.
+func (r *Resolver) lookupASNs(addrs []string) map[string]ASN {
+	asns := map[string]ASN{}
+	for _, addr := range addrs {
+		asn, err := r.ASN.Lookup(addr)
+		if err != nil || asn.Number == 0 {
+			continue
+		}
+		asns[addr] = asn
+	}
+	return asns
+}
+
+// withTimeout bounds a lookup by the resolver's timeout, if there is one.
+func (r *Resolver) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.Timeout > 0 {
+		return context.WithTimeout(ctx, r.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// NewDNSResolver builds a resolver that sends queries to the given host:port
+// nameservers, rotating through them and failing over to the next when one
+// can't be reached. With no servers the system resolver is used.
+func NewDNSResolver(servers []string) *net.Resolver {
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			// no port given, use the standard DNS port
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs[i] = server
+	}
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			start := int(atomic.AddUint32(&next, 1))
+			d := net.Dialer{}
+			var err error
+			for i := range addrs {
+				var conn net.Conn
+				conn, err = d.DialContext(ctx, network, addrs[(start+i)%len(addrs)])
+				if err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+}
@@ -0,0 +1,276 @@
+package ctscan
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS is a UDP nameserver answering A and AAAA queries from a fixed
+// table, and NXDOMAIN for anything not in it. It waits delay, guarded by mu,
+// before each answer.
+type fakeDNS struct {
+	delay   time.Duration
+	conn    net.PacketConn
+	addrs   map[string][]net.IP
+	queries int64
+	mu      sync.Mutex
+	byName  map[string]int
+}
+
+func newFakeDNS(t *testing.T, addrs map[string][]string) *fakeDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeDNS{conn: conn, addrs: map[string][]net.IP{}, byName: map[string]int{}}
+	for name, list := range addrs {
+		for _, addr := range list {
+			f.addrs[name+"."] = append(f.addrs[name+"."], net.ParseIP(addr))
+		}
+	}
+	go f.serve()
+	t.Cleanup(func() { conn.Close() })
+	return f
+}
+
+func (f *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) != 1 {
+			continue
+		}
+		atomic.AddInt64(&f.queries, 1)
+		q := msg.Questions[0]
+		name := strings.ToLower(q.Name.String())
+		f.mu.Lock()
+		f.byName[strings.TrimSuffix(name, ".")]++
+		delay := f.delay
+		f.mu.Unlock()
+		time.Sleep(delay)
+		ips, ok := f.addrs[name]
+		header := dnsmessage.Header{ID: msg.ID, Response: true, Authoritative: true}
+		if !ok {
+			header.RCode = dnsmessage.RCodeNameError
+		}
+		b := dnsmessage.NewBuilder(nil, header)
+		b.EnableCompression()
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip4)
+				b.AResource(rh, a)
+			} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+				var aaaa dnsmessage.AAAAResource
+				copy(aaaa.AAAA[:], ip)
+				b.AAAAResource(rh, aaaa)
+			}
+		}
+		out, err := b.Finish()
+		if err != nil {
+			continue
+		}
+		f.conn.WriteTo(out, from)
+	}
+}
+
+// lookups returns how many queries were made for name.
+func (f *fakeDNS) lookups(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.byName[name]
+}
+
+func (f *fakeDNS) resolver() *Resolver {
+	r := NewResolver()
+	r.DNS = NewDNSResolver([]string{f.conn.LocalAddr().String()})
+	return r
+}
+
+func TestLookupFamily(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]string{
+		"v4.example.test":   {"192.0.2.1"},
+		"v6.example.test":   {"2001:db8::1"},
+		"dual.example.test": {"192.0.2.2", "2001:db8::2"},
+	})
+	tests := []struct {
+		network string
+		name    string
+		want    []string
+		wantErr bool
+	}{
+		{"ip", "v4.example.test", []string{"192.0.2.1"}, false},
+		{"ip", "dual.example.test", []string{"192.0.2.2", "2001:db8::2"}, false},
+		{"ip4", "v4.example.test", []string{"192.0.2.1"}, false},
+		{"ip4", "v6.example.test", []string{}, false},
+		{"ip4", "dual.example.test", []string{"192.0.2.2"}, false},
+		{"ip6", "v4.example.test", []string{}, false},
+		{"ip6", "v6.example.test", []string{"2001:db8::1"}, false},
+		{"ip6", "dual.example.test", []string{"2001:db8::2"}, false},
+		{"ip", "missing.example.test", nil, true},
+		{"ip4", "missing.example.test", nil, true},
+	}
+	for _, tt := range tests {
+		r := dns.resolver()
+		r.Network = tt.network
+		got, err := r.lookupOnce(context.Background(), tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s %s: error %v, want error %v", tt.network, tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			if !IsNotFound(err) {
+				t.Errorf("%s %s: error %v isn't a not found error", tt.network, tt.name, err)
+			}
+			continue
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s: got %q, want %q", tt.network, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllRecordsLookups(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]string{
+		"a.example.test": {"192.0.2.1"},
+		"b.example.test": {"192.0.2.2"},
+		"c.example.test": {"192.0.2.3"},
+	})
+	dns.mu.Lock()
+	dns.delay = 20 * time.Millisecond
+	dns.mu.Unlock()
+	tests := []struct {
+		name         string
+		names        []string
+		maxNames     int
+		wantResolved int64
+		wantKept     int
+	}{
+		{"concurrent", []string{"a", "a", "a", "a", "a", "a", "a", "a"}, 0, 1, 1},
+		{"bounded", []string{"a", "b", "c"}, 2, 3, 2},
+	}
+	for _, tt := range tests {
+		r := dns.resolver()
+		r.AllRecords = true
+		r.MaxNames = tt.maxNames
+		r.Workers = len(tt.names)
+		in := make(chan Record, len(tt.names))
+		out := make(chan Record, len(tt.names))
+		for i, name := range tt.names {
+			in <- Record{Name: name + ".example.test", SerialNumber: string(rune('0' + i))}
+		}
+		close(in)
+		if err := r.Resolve(context.Background(), in, out); err != nil {
+			t.Fatal(err)
+		}
+		close(out)
+		got := 0
+		for record := range out {
+			got++
+			if len(record.Addrs) != 1 || record.Err != nil {
+				t.Errorf("%s: %s got %q, %v, want one address", tt.name, record.Name, record.Addrs, record.Err)
+			}
+		}
+		if got != len(tt.names) {
+			t.Errorf("%s: got %d records, want %d", tt.name, got, len(tt.names))
+		}
+		if resolved := atomic.LoadInt64(&r.resolvedCount); resolved != tt.wantResolved {
+			t.Errorf("%s: looked up %d times, want %d", tt.name, resolved, tt.wantResolved)
+		}
+		if kept := len(r.earlier); kept != tt.wantKept {
+			t.Errorf("%s: kept lookups for %d names, want %d", tt.name, kept, tt.wantKept)
+		}
+	}
+}
+
+func TestResolveKeepsCertFields(t *testing.T) {
+	cert := Record{
+		From:          "example.com",
+		Issuer:        "R3",
+		IssuerOrg:     "Let's Encrypt",
+		NotBeforeTime: 1600000000000,
+		NotAfterTime:  1700000000000,
+		CertCount:     2,
+		SerialNumber:  "01",
+	}
+	tests := []struct {
+		name  string
+		addrs []string
+	}{
+		{"www.example.test", []string{"192.0.2.1"}},
+		{"*.example.test", nil},
+		{`"Example Corp"`, nil},
+	}
+	r := newFakeDNS(t, map[string][]string{"www.example.test": {"192.0.2.1"}}).resolver()
+	for _, tt := range tests {
+		in := make(chan Record, 1)
+		out := make(chan Record, 1)
+		want := cert
+		want.Name = tt.name
+		in <- want
+		close(in)
+		want.Addrs = tt.addrs
+		if err := r.Resolve(context.Background(), in, out); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-out; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, want)
+		}
+	}
+}
+
+func TestIsResolvable(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"_dmarc.example.com", true},
+		{"*.example.com", false},
+		{"admin@example.com", false},
+		{"URI:https://example.com/", false},
+		{"Example Corp", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		if got := IsResolvable(tt.name); got != tt.want {
+			t.Errorf("IsResolvable(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIPLiteral(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		want    []string
+	}{
+		{"2001:DB8:0::1", "ip", []string{"2001:db8::1"}},
+		{"[2001:db8::1]", "ip6", []string{"2001:db8::1"}},
+		{"192.0.2.1", "ip6", []string{}},
+		{"192.0.2.1.example.com", "ip", nil},
+	}
+	for _, tt := range tests {
+		if got := ipLiteral(tt.name, tt.network); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ipLiteral(%q, %s) = %#v, want %#v", tt.name, tt.network, got, tt.want)
+		}
+	}
+}
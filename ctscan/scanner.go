@@ -0,0 +1,532 @@
+package ctscan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// ErrDomainTimeout marks a domain whose scan ran past the Scanner's
+// DomainTimeout, so its results are incomplete.
+var ErrDomainTimeout = errors.New("domain timed out before all results were fetched")
+
+// A Source looks up the certificate transparency records for a domain and
+// its subdomains.
+type Source interface {
+	Scan(ctx context.Context, domain string) ([]Record, error)
+}
+
+// A Scanner processes a stream of domain names, looking them up in a
+// certificate transparency Source. One scanner can process many domains in
+// parallel.
+type Scanner struct {
+	// counters are updated atomically. They come first to keep them 64-bit
+	// aligned.
+	completed int64
+	records   int64
+	failed    int64
+	active    int64
+
+	// IDN converts internationalized domain names to their punycode form
+	// before scanning, which is the form CT sources expect.
+	IDN bool
+	// Log receives progress messages. It may be nil.
+	Log *Logger
+	// Checkpoint, if set, has each successfully scanned domain written to it
+	// as a line of its own, for reading back with ReadCheckpoint. A domain is
+	// only written once every record sent for it has been passed to Release
+	// or Drop, so it isn't recorded before its results are out, and with
+	// recursive discovery, not before the domains found from it are done
+	// too. Domains that fail or hit DomainTimeout aren't written, and neither
+	// are the others in the same recursive scan.
+	Checkpoint io.Writer
+	// MaxDepth enables recursive discovery. The registrable domain of every
+	// name found is scanned too, if it hasn't been already, and so on up to
+	// MaxDepth levels away from the input domain. Zero disables recursion.
+	MaxDepth int
+	// Scope, if set, has every domain read by ScanStream added to it, but
+	// not those found by recursive discovery.
+	Scope *Scope
+	// Exclude, if set, holds domains that aren't scanned. Input domains and
+	// domains found by recursive discovery that are in it are skipped.
+	Exclude *Scope
+	// MaxDomains, if more than zero, limits how many input domains are
+	// scanned. Only domains that are accepted count, not repeats or domains
+	// that are invalid, excluded, or passed to Skip. Once it's reached, any
+	// more input domains are passed over, and LimitReached reports true.
+	MaxDomains int
+	// Strict makes ScanStream fail on an invalid input domain instead of
+	// skipping it with a warning.
+	Strict bool
+	// Subdomains has subdomains of each domain scanned too. It's the default
+	// for input lines that don't give a subdomains option.
+	Subdomains bool
+	// CollapseNames merges the records for each name found for a domain into
+	// one, with CertCount set to the number of certificates it appeared on.
+	// The details of the latest-expiring certificate are kept.
+	CollapseNames bool
+	// ContinueOnError keeps going when a domain can't be scanned. Instead of
+	// ScanStream returning the error, a Record for the domain is sent with
+	// just From and Err set, and the next domain is scanned.
+	ContinueOnError bool
+	// DomainTimeout, if set, limits how long each domain's scan can take,
+	// across all of its pages. When it runs out, the records found so far
+	// are kept, followed by a Record with just From set and Err set to
+	// ErrDomainTimeout, and the next domain is scanned.
+	DomainTimeout time.Duration
+	// OnDone, if set, is called after each domain's records have all been
+	// sent, with how many there were, whether or not its scan succeeded.
+	// With several goroutines running ScanStream, it may be called
+	// concurrently.
+	OnDone func(domain string, records int)
+
+	source  Source
+	lock    sync.Mutex
+	scanned *seenSet
+	skipped int64
+	// accepted counts the input domains toward MaxDomains. Guarded by lock.
+	accepted int
+	// trees holds the recursive scans waiting to be checkpointed, by each of
+	// their domains. Guarded by lock.
+	trees         map[string]*pendingTree
+	checkpointErr error
+}
+
+// NewScanner returns a Scanner that looks domains up in source, including
+// their subdomains, with IDN conversion enabled.
+func NewScanner(source Source) *Scanner {
+	return &Scanner{
+		IDN:        true,
+		Subdomains: true,
+		source:     source,
+		scanned:    newSeenSet(0),
+	}
+}
+
+// ScanStream loops over a channel of domain strings, scans them, and writes
+// records to an output stream. It returns when in is closed. Domains that have
+// already been scanned by this Scanner are skipped.
+//
+// A domain can be followed by options, separated by spaces: "subdomains" or
+// "!subdomains" overrides the Subdomains setting for that domain, as in
+// "example.com !subdomains". "exact" is the same as "!subdomains". Unknown
+// options are ignored with a warning.
+func (s *Scanner) ScanStream(ctx context.Context, in <-chan string, out chan<- Record) error {
+	for {
+		var line string
+		select {
+		case l, ok := <-in:
+			if !ok {
+				return nil
+			}
+			line = l
+		case <-ctx.Done():
+			// whatever feeds in may be blocked, like on reading STDIN
+			return ctx.Err()
+		}
+		domain, subdomains := s.parseOptions(line)
+		domain, ok, err := s.accept(domain)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		tree := s.startTree()
+		err = s.scanTree(WithSubdomains(ctx, subdomains), tree, domain, 0, out)
+		s.finishTree(tree, err == nil)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseOptions splits an input line into its domain and options, returning
+// whether subdomains should be scanned.
+func (s *Scanner) parseOptions(line string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", s.Subdomains
+	}
+	subdomains := s.Subdomains
+	for _, option := range fields[1:] {
+		switch option {
+		case "subdomains":
+			subdomains = true
+		case "!subdomains", "exact":
+			subdomains = false
+		default:
+			s.Log.Warnf("%s: ignoring unknown option %q", fields[0], option)
+		}
+	}
+	return fields[0], subdomains
+}
+
+// subdomainsKey is the context key for WithSubdomains.
+type subdomainsKey struct{}
+
+// WithSubdomains returns a context that tells Sources whether to include the
+// subdomains of the domain being scanned. Without it they're included.
+func WithSubdomains(ctx context.Context, include bool) context.Context {
+	return context.WithValue(ctx, subdomainsKey{}, include)
+}
+
+// includeSubdomains reports whether a scan with ctx should include
+// subdomains.
+func includeSubdomains(ctx context.Context) bool {
+	include, ok := ctx.Value(subdomainsKey{}).(bool)
+	return include || !ok
+}
+
+// pagesKey is the context key for a scan's page count.
+type pagesKey struct{}
+
+// withPageCount returns a context in which Sources count the pages of
+// results they fetch in *pages.
+func withPageCount(ctx context.Context, pages *int64) context.Context {
+	return context.WithValue(ctx, pagesKey{}, pages)
+}
+
+// countPage records that a Source scanning with ctx fetched a page of
+// results.
+func countPage(ctx context.Context) {
+	if pages, ok := ctx.Value(pagesKey{}).(*int64); ok {
+		atomic.AddInt64(pages, 1)
+	}
+}
+
+// Plan reads domains the same way ScanStream does, but rather than scanning
+// them it calls fn with each domain that would be scanned, in the form it
+// would be scanned in. Nothing is looked up, so recursive discovery doesn't
+// happen. Planned domains count as scanned afterward. Like ScanStream, it
+// returns an error for an invalid domain if Strict is set.
+func (s *Scanner) Plan(in <-chan string, fn func(domain string)) error {
+	for line := range in {
+		domain, _ := s.parseOptions(line)
+		domain, ok, err := s.accept(domain)
+		if err != nil {
+			return err
+		}
+		if ok {
+			fn(domain)
+		}
+	}
+	return nil
+}
+
+// accept prepares an input domain for scanning, reporting false if it
+// shouldn't be scanned because it's invalid, excluded, or has already been
+// seen. Invalid domains are an error if Strict is set.
+func (s *Scanner) accept(domain string) (string, bool, error) {
+	input := domain
+	domain, idnErr, err := s.normalize(domain)
+	if idnErr != nil {
+		s.Log.Warnf("converting %q to punycode: %v", domain, idnErr)
+	}
+	if err != nil {
+		if s.Strict {
+			return "", false, fmt.Errorf("invalid domain %q: %w", input, err)
+		}
+		s.Log.Warnf("skipping invalid domain %q: %v", input, err)
+		return "", false, nil
+	}
+	if s.Exclude != nil && s.Exclude.Contains(domain) {
+		s.Log.Infof("skipping excluded domain %s", domain)
+		return "", false, nil
+	}
+	if s.Scope != nil {
+		s.Scope.Add(domain)
+	}
+	if !s.claimInput(domain) {
+		// This domain has already been seen, or MaxDomains is reached. Skip
+		// it
+		return "", false, nil
+	}
+	return domain, true, nil
+}
+
+// claimInput claims an input domain like claim, counting it toward
+// MaxDomains. Once the limit is reached, nothing more is claimed, so a domain
+// passed over for it can still be found by recursive discovery.
+func (s *Scanner) claimInput(domain string) bool {
+	if s.MaxDomains <= 0 {
+		return s.claim(domain)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.accepted >= s.MaxDomains || !s.claim(domain) {
+		return false
+	}
+	s.accepted++
+	return true
+}
+
+// LimitReached reports whether MaxDomains input domains have been accepted,
+// so there's no point reading any more.
+func (s *Scanner) LimitReached() bool {
+	if s.MaxDomains <= 0 {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accepted >= s.MaxDomains
+}
+
+// normalize strips an input domain down to the form it's scanned in,
+// converting it to punycode if IDN is set, and validates it. A domain that
+// can't be converted is kept as given, with idnErr saying why.
+func (s *Scanner) normalize(domain string) (normalized string, idnErr, err error) {
+	domain = normalizeDomain(stripURL(domain))
+	if s.IDN {
+		ascii, err := idna.ToASCII(domain)
+		if err != nil {
+			// try the domain as given rather than dropping it
+			idnErr = err
+		} else {
+			domain = ascii
+		}
+	}
+	return domain, idnErr, validateDomain(domain)
+}
+
+// claim marks a domain as scanned, reporting false if it already was. The
+// check and the mark happen together before any scanning starts, so when the
+// same domain reaches several goroutines at once only one of them scans it,
+// whether it came from the input or from recursive discovery. The domain is
+// normalized first, so however it's written it has just one entry. Every
+// addition to the scanned set goes through here.
+func (s *Scanner) claim(domain string) bool {
+	return s.scanned.Add(normalizeDomain(domain))
+}
+
+// scanTree scans a domain and sends its records to out. If depth is less than
+// MaxDepth, the registrable domains of the names found are then scanned in
+// turn, one level deeper, skipping any that have already been scanned.
+func (s *Scanner) scanTree(ctx context.Context, tree *pendingTree, domain string, depth int, out chan<- Record) error {
+	s.joinTree(tree, domain)
+	var names []string
+	sent := 0
+	err := s.Scan(ctx, domain, func(record Record) {
+		s.hold(tree)
+		out <- record
+		sent++
+		if record.Err == ErrDomainTimeout {
+			// incomplete, so not checkpointed and a resumed run tries it
+			// again. It's a marker rather than a found name, so it isn't
+			// counted in Records.
+			s.failTree(tree)
+			return
+		}
+		atomic.AddInt64(&s.records, 1)
+		if depth < s.MaxDepth {
+			names = append(names, record.Name)
+		}
+	})
+	skipped := err != nil && s.ContinueOnError && ctx.Err() == nil
+	if skipped {
+		// not checkpointed, so a resumed run tries it again
+		s.Log.Warnf("scanning %s: %v", domain, err)
+		s.failTree(tree)
+		s.hold(tree)
+		out <- Record{From: domain, Err: err}
+		sent++
+	}
+	if s.OnDone != nil {
+		// before any recursion, which sends records for other domains
+		s.OnDone(domain, sent)
+	}
+	if skipped {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.completed, 1)
+
+	for _, name := range names {
+		child, err := publicsuffix.EffectiveTLDPlusOne(normalizeDomain(name))
+		if err != nil || (s.Exclude != nil && s.Exclude.Contains(child)) || !s.claim(child) {
+			// not a domain name, excluded, or already scanned
+			continue
+		}
+		s.Log.Infof("%s: found %s, scanning at depth %d", domain, child, depth+1)
+		if err := s.scanTree(ctx, tree, child, depth+1, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Skip marks domains as already scanned so ScanStream passes over them, such
+// as those read from a checkpoint. They aren't counted by Scanned.
+func (s *Scanner) Skip(domains ...string) {
+	for _, domain := range domains {
+		if s.claim(domain) {
+			atomic.AddInt64(&s.skipped, 1)
+		}
+	}
+}
+
+// Completed returns the number of domains that have finished scanning.
+func (s *Scanner) Completed() int64 {
+	return atomic.LoadInt64(&s.completed)
+}
+
+// Failed returns the number of domains whose scans failed.
+func (s *Scanner) Failed() int64 {
+	return atomic.LoadInt64(&s.failed)
+}
+
+// Active returns the number of domains being looked up right now.
+func (s *Scanner) Active() int64 {
+	return atomic.LoadInt64(&s.active)
+}
+
+// Records returns the number of records the Scanner has sent out.
+func (s *Scanner) Records() int64 {
+	return atomic.LoadInt64(&s.records)
+}
+
+// Scanned returns the number of distinct domains this Scanner has taken from
+// its input streams.
+func (s *Scanner) Scanned() int {
+	return s.scanned.Len() - int(atomic.LoadInt64(&s.skipped))
+}
+
+// Scan looks up a single domain, calling fn with each record found. Records
+// are marked with the domain they came from. If the source fails partway
+// through, the records it did find are still passed to fn before the error is
+// returned.
+func (s *Scanner) Scan(ctx context.Context, domain string, fn func(Record)) error {
+	s.Log.Infof("scanning %s", domain)
+	atomic.AddInt64(&s.active, 1)
+	var pages int64
+	scanCtx := ctx
+	if s.DomainTimeout > 0 {
+		var cancel context.CancelFunc
+		scanCtx, cancel = context.WithTimeout(ctx, s.DomainTimeout)
+		defer cancel()
+	}
+	records, err := s.source.Scan(withPageCount(scanCtx, &pages), domain)
+	atomic.AddInt64(&s.active, -1)
+	timedOut := err != nil && scanCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+	if timedOut {
+		s.Log.Warnf("%s: stopped at the domain timeout of %s with %d records from %d pages, results are incomplete", domain, s.DomainTimeout, len(records), atomic.LoadInt64(&pages))
+		err = nil
+	} else if err != nil {
+		atomic.AddInt64(&s.failed, 1)
+	}
+	// one line per domain so ones with suspiciously few results stand out
+	s.Log.Infof("%s: %d records from %d pages", domain, len(records), atomic.LoadInt64(&pages))
+	if s.CollapseNames {
+		records = collapseNames(records)
+	}
+	for _, record := range records {
+		// mark each record with which domain it came from and send it
+		record.From = domain
+		fn(record)
+	}
+	if timedOut {
+		fn(Record{From: domain, Err: ErrDomainTimeout})
+	}
+	return err
+}
+
+// collapseNames merges records with the same name, keeping the first
+// appearance order. Each merged record counts the records it replaced in
+// CertCount, spans their validity in FirstSeen and LastSeen, and keeps the
+// fields of the one that expires last.
+func collapseNames(records []Record) []Record {
+	var collapsed []Record
+	index := map[string]int{}
+	for _, record := range records {
+		i, present := index[record.Name]
+		if !present {
+			index[record.Name] = len(collapsed)
+			record.CertCount = 1
+			record.FirstSeen = record.NotBeforeTime
+			record.LastSeen = record.NotAfterTime
+			collapsed = append(collapsed, record)
+			continue
+		}
+		merged := collapsed[i]
+		if record.NotAfterTime > merged.NotAfterTime {
+			collapsed[i] = record
+		}
+		collapsed[i].CertCount = merged.CertCount + 1
+		collapsed[i].FirstSeen = merged.FirstSeen
+		if record.NotBeforeTime != 0 && (merged.FirstSeen == 0 || record.NotBeforeTime < merged.FirstSeen) {
+			// unknown times are zero, so they don't count as earliest
+			collapsed[i].FirstSeen = record.NotBeforeTime
+		}
+		collapsed[i].LastSeen = merged.LastSeen
+		if record.NotAfterTime > merged.LastSeen {
+			collapsed[i].LastSeen = record.NotAfterTime
+		}
+	}
+	return collapsed
+}
+
+// stripURL cuts a URL, or something that looks like one, down to its host,
+// for when a URL is given where a domain was expected.
+func stripURL(d string) string {
+	if i := strings.Index(d, "://"); i >= 0 {
+		d = d[i+3:]
+	}
+	if i := strings.IndexAny(d, "/?#"); i >= 0 {
+		d = d[:i]
+	}
+	if i := strings.LastIndex(d, "@"); i >= 0 {
+		d = d[i+1:]
+	}
+	if host, _, err := net.SplitHostPort(d); err == nil {
+		d = host
+	}
+	return d
+}
+
+// validateDomain checks that d, after normalization and punycode conversion,
+// looks like a domain name: at least two dot-separated labels made of
+// letters, digits, hyphens, and underscores. Non-ASCII letters are allowed
+// for when IDN conversion is off.
+func validateDomain(d string) error {
+	if len(d) > 253 {
+		return errors.New("too long")
+	}
+	labels := strings.Split(d, ".")
+	if len(labels) < 2 {
+		return errors.New("not a domain name")
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("bad label %q", label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c >= utf8.RuneSelf) {
+				return fmt.Errorf("invalid character %q", c)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeDomain tries to normalize domain name strings so equivalent forms
+// are only scanned once. It's intentionally conservative: it lowercases,
+// drops a single trailing dot and a leading wildcard label, and otherwise
+// leaves the name alone.
+func normalizeDomain(d string) string {
+	d = strings.ToLower(strings.TrimSpace(d))
+	d = strings.TrimSuffix(d, ".")
+	d = strings.TrimPrefix(d, "*.")
+	return d
+}
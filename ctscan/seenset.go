@@ -0,0 +1,79 @@
+package ctscan
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+)
+
+// seenShards is how many independently locked parts a seenSet is split into,
+// so concurrent workers rarely wait on each other.
+const seenShards = 32
+
+// A seenSet records names that have been seen, safe for concurrent use. It can
+// be bounded, in which case the least recently seen names are forgotten to
+// make room for new ones.
+type seenSet struct {
+	// limit, if positive, is roughly the most names the set holds.
+	limit  int
+	shards [seenShards]seenShard
+}
+
+type seenShard struct {
+	lock  sync.Mutex
+	names map[string]*list.Element
+	// order holds the shard's names, most recently seen first. It's only
+	// kept up when the set is bounded.
+	order *list.List
+}
+
+// newSeenSet returns an empty seenSet holding roughly at most limit names, or
+// any number if limit isn't positive.
+func newSeenSet(limit int) *seenSet {
+	s := &seenSet{limit: limit}
+	for i := range s.shards {
+		s.shards[i].names = map[string]*list.Element{}
+		s.shards[i].order = list.New()
+	}
+	return s
+}
+
+// Add marks name as seen, reporting false if it already was.
+func (s *seenSet) Add(name string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	shard := &s.shards[h.Sum32()%seenShards]
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if e, present := shard.names[name]; present {
+		if e != nil {
+			shard.order.MoveToFront(e)
+		}
+		return false
+	}
+	if s.limit <= 0 {
+		shard.names[name] = nil
+		return true
+	}
+	shard.names[name] = shard.order.PushFront(name)
+	// spread the limit across the shards, rounding up
+	for max := (s.limit + seenShards - 1) / seenShards; shard.order.Len() > max; {
+		oldest := shard.order.Back()
+		shard.order.Remove(oldest)
+		delete(shard.names, oldest.Value.(string))
+	}
+	return true
+}
+
+// Len returns the number of names in the set.
+func (s *seenSet) Len() int {
+	n := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		n += len(shard.names)
+		shard.lock.Unlock()
+	}
+	return n
+}
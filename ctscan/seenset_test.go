@@ -0,0 +1,148 @@
+package ctscan
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// sameShard returns n names that fall in the same shard of a seenSet.
+func sameShard(n int) []string {
+	var names []string
+	for i := 0; len(names) < n; i++ {
+		name := fmt.Sprintf("name%d.example.com", i)
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		if h.Sum32()%seenShards == 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestSeenSetAdd(t *testing.T) {
+	names := sameShard(3)
+	a, b, c := names[0], names[1], names[2]
+	type step struct {
+		name string
+		want bool
+	}
+	tests := []struct {
+		desc  string
+		limit int
+		steps []step
+	}{
+		{"unbounded", 0, []step{{a, true}, {b, true}, {a, false}, {c, true}, {b, false}}},
+		// two names to a shard; seeing a name again makes it the most
+		// recent, so the other is forgotten first
+		{"bounded", 2 * seenShards, []step{{a, true}, {b, true}, {a, false}, {c, true}, {a, false}, {b, true}}},
+	}
+	for _, tt := range tests {
+		s := newSeenSet(tt.limit)
+		for i, step := range tt.steps {
+			if got := s.Add(step.name); got != step.want {
+				t.Errorf("%s: step %d, Add(%q) = %v, want %v", tt.desc, i, step.name, got, step.want)
+			}
+		}
+	}
+}
+
+func TestSeenSetConcurrent(t *testing.T) {
+	const (
+		goroutines = 16
+		keys       = 2000
+	)
+	tests := []struct {
+		name  string
+		limit int
+	}{
+		{"unbounded", 0},
+		{"bounded", 500},
+		// roomy enough that nothing is forgotten
+		{"bounded above the keys", 4 * keys},
+	}
+	for _, tt := range tests {
+		s := newSeenSet(tt.limit)
+		var claims [keys]int64
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				// every goroutine goes through all the keys, starting at a
+				// different place so they overlap
+				for i := 0; i < keys; i++ {
+					k := (i + g*keys/goroutines) % keys
+					if s.Add(fmt.Sprintf("name%d.example.com", k)) {
+						atomic.AddInt64(&claims[k], 1)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		for k, n := range claims {
+			if (tt.limit == 0 || tt.limit >= 4*keys) && n != 1 {
+				t.Errorf("%s: name%d claimed %d times, want once", tt.name, k, n)
+			}
+			if n < 1 {
+				t.Errorf("%s: name%d never claimed", tt.name, k)
+			}
+		}
+		// the limit is spread across the shards, rounding up
+		max := tt.limit
+		if max > 0 {
+			max = (tt.limit + seenShards - 1) / seenShards * seenShards
+		} else {
+			max = keys
+		}
+		if n := s.Len(); n > max {
+			t.Errorf("%s: holds %d names, want at most %d", tt.name, n, max)
+		}
+	}
+}
+
+func TestScannerClaimConcurrent(t *testing.T) {
+	s := NewScanner(nil)
+	spellings := []string{"example.com", "Example.COM", "example.com.", "*.example.com"}
+	var claimed int64
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			if s.claim(spellings[g%len(spellings)]) {
+				atomic.AddInt64(&claimed, 1)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if claimed != 1 {
+		t.Errorf("claimed %d times, want once", claimed)
+	}
+}
+
+// BenchmarkSeenSetAdd measures Add from many goroutines at once, as the
+// resolver workers call it, with names that mostly repeat.
+func BenchmarkSeenSetAdd(b *testing.B) {
+	names := make([]string, 1<<16)
+	for i := range names {
+		names[i] = fmt.Sprintf("name%d.example.com", i)
+	}
+	for _, limit := range []int{0, 1 << 12} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			s := newSeenSet(limit)
+			var start int64
+			b.RunParallel(func(pb *testing.PB) {
+				// each goroutine starts somewhere else in the names
+				i := int(atomic.AddInt64(&start, 7919))
+				for pb.Next() {
+					s.Add(names[i%len(names)])
+					i++
+				}
+			})
+		})
+	}
+}
@@ -1,10 +1,28 @@
 module github.com/jasonmf/mfctscan
 
-go 1.15
+go 1.23.0
 
 require (
 	github.com/bitly/go-simplejson v0.5.0
+	github.com/oschwald/maxminddb-golang v1.8.0
+	golang.org/x/net v0.0.0-20201209123823-ac852fbbde11
+	golang.org/x/sync v0.14.0
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
+	modernc.org/sqlite v1.37.1
+)
+
+require (
 	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	github.com/kr/pretty v0.2.1 // indirect
-	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/exp v0.0.0-20250408133849-7e4ce0ab07d0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.3.3 // indirect
+	modernc.org/libc v1.65.7 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.11.0 // indirect
 )
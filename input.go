@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"strings"
+)
+
+// feedDomains reads newline-separated domains from src and sends them to out.
+// Leading and trailing whitespace is stripped, and empty lines and lines
+// starting with # are skipped. If full is set, it stops reading once full
+// reports true, as it does when the scanners have taken all the domains they
+// will. It returns ctx's error if ctx is done first, even when blocked waiting
+// for the scanners to take a domain.
+func feedDomains(ctx context.Context, src io.Reader, out chan<- string, full func() bool) error {
+	lineScanner := bufio.NewScanner(src)
+	for lineScanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if full != nil && full() {
+			return nil
+		}
+		line, ok := domainLine(lineScanner.Text())
+		if !ok {
+			continue
+		}
+		select {
+		case out <- line:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return lineScanner.Err()
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompress returns a reader for the contents of r, which are decompressed
+// if they start with the gzip magic number and passed through otherwise.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil || string(magic) != string(gzipMagic) {
+		// too short to be gzip, or not gzip; any read error comes up again
+		// for whoever reads it
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// readDomainsFile reads the domains listed in a file, with the same rules as
+// feedDomains. A gzipped file is decompressed.
+func readDomainsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	var domains []string
+	lineScanner := bufio.NewScanner(r)
+	for lineScanner.Scan() {
+		if line, ok := domainLine(lineScanner.Text()); ok {
+			domains = append(domains, line)
+		}
+	}
+	return domains, lineScanner.Err()
+}
+
+// domainLine strips whitespace from a line of a domain list, reporting false
+// for empty lines and comments.
+func domainLine(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		// skip empty lines and comments
+		return "", false
+	}
+	return line, true
+}
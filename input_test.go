@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeedDomainsFull(t *testing.T) {
+	out := make(chan string, 100)
+	full := func() bool { return len(out) >= 2 }
+	input := "# comment\n\na.example\nb.example exact\nc.example\n"
+	if err := feedDomains(context.Background(), strings.NewReader(input), out, full); err != nil {
+		t.Fatal(err)
+	}
+	close(out)
+	got := []string{}
+	for line := range out {
+		got = append(got, line)
+	}
+	if want := []string{"a.example", "b.example exact"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestFeedDomainsCancel(t *testing.T) {
+	// out has room for one domain and nothing reads from it, so feeding
+	// blocks on the second until it's cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- feedDomains(ctx, strings.NewReader("a.example\nb.example\nc.example\n"), out, nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still feeding a second after being cancelled")
+	}
+	if len(out) != 1 {
+		t.Errorf("sent %d domains, want 1", len(out))
+	}
+
+	// already cancelled, so nothing is sent even with room
+	out = make(chan string, 3)
+	if err := feedDomains(ctx, strings.NewReader("a.example\n"), out, nil); err != context.Canceled || len(out) != 0 {
+		t.Errorf("already cancelled: got error %v with %d sent, want %v with none", err, len(out), context.Canceled)
+	}
+}
@@ -2,119 +2,1307 @@ package main
 
 import (
 	"bufio"
-	"encoding/csv"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/jasonmf/mfctscan/ctscan"
+	"golang.org/x/net/idna"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 )
 
 var (
-	fMaxPages  = flag.Int("max-pages", 50, "maximum result pages per domain")
-	fResolvers = flag.Int("resolvers", 10, "number of concurrent resovlers. More is safe but won't speed things up much")
-	fScanners  = flag.Int("scanners", 5, "number of concurrent scanners. More will make things faster but risk rate limiting")
+	fOutput               string
+	fDomainsFile          = flag.String("domains-file", "", "read domains from this file instead of STDIN")
+	fIPVersion            = flag.String("ip-version", "any", "address family to resolve: any, 4, or 6")
+	fNoIDN                = flag.Bool("no-idn", false, "don't convert internationalized domain names to punycode before scanning")
+	fUnicode              = flag.Bool("unicode", false, "write punycode (xn--) names as Unicode in the output")
+	fMaxPages             = flag.Int("max-pages", 50, "maximum result pages per domain")
+	fResolvers            = flag.Int("resolvers", 10, "number of concurrent resovlers. More is safe but won't speed things up much")
+	fSource               = flag.String("source", "google", "certificate transparency source: google or crtsh")
+	fScanners             = flag.Int("scanners", 5, "number of concurrent scanners. More will make things faster but risk rate limiting")
+	fDNSTimeout           = flag.Duration("dns-timeout", 5*time.Second, "maximum time to wait for each DNS lookup. 0 waits as long as the system resolver does")
+	fSummary              = flag.Bool("summary", false, "print a summary of the run to STDERR when finished")
+	fLogLevel             = flag.String("log-level", "warn", "log verbosity on STDERR: error, warn, info, or debug")
+	fCheckpoint           = flag.String("checkpoint", "", "record completed domains in this file")
+	fResume               = flag.Bool("resume", false, "skip domains already recorded in the -checkpoint file")
+	fUserAgent            = flag.String("user-agent", "", "User-Agent header to send instead of the built-in browser string")
+	fRate                 = flag.Float64("rate", 0, "maximum requests per second across all scanners. 0 means no limit")
+	fPTR                  = flag.Bool("ptr", false, "look up reverse DNS (PTR) names for resolved addresses, written as an extra column")
+	fCNAME                = flag.Bool("cname", false, "look up the CNAME target of each name, written as an extra column")
+	fCertIDs              = flag.Bool("cert-ids", false, "write certificate serial number and fingerprint columns")
+	fIssuerInfo           = flag.Bool("issuer-info", false, "write issuer organization and common name columns")
+	fValidity             = flag.Bool("validity", false, "write certificate not before and not after columns")
+	fMaxRecords           = flag.Int("max-records", 0, "maximum records per domain. 0 means no limit")
+	fRecursive            = flag.Bool("recursive", false, "also scan the registrable domains of discovered names")
+	fMaxDepth             = flag.Int("max-depth", 1, "how many levels of discovered domains -recursive follows")
+	fInScopeOnly          = flag.Bool("in-scope-only", false, "drop names that aren't an input domain or a subdomain of one")
+	fNoResolve            = flag.Bool("no-resolve", false, "don't resolve discovered names, just list them")
+	fUnresolvedOnly       = flag.Bool("unresolved-only", false, "only write names that don't exist in DNS or have no addresses")
+	fProgress             = flag.Duration("progress", 0, "print progress to STDERR at this interval. 0 disables it")
+	fPublicOnly           = flag.Bool("public-only", false, "drop private, loopback, link-local, and other reserved addresses")
+	fSQLite               = flag.String("sqlite", "", "store results in this SQLite database instead of writing CSV")
+	fMaxNames             = flag.Int("max-names", 0, "maximum names the resolvers remember to skip repeats. 0 means no limit")
+	fMX                   = flag.Bool("mx", false, "look up the mail servers (MX) of each name, written as an extra column")
+	fTXT                  = flag.Bool("txt", false, "look up the TXT records of each name, written as an extra column")
+	fColumns              = flag.String("columns", "", "comma-separated columns to write, in order. Defaults to the standard columns plus any enabled by flags")
+	fASN                  = flag.Bool("asn", false, "look up the autonomous system of resolved addresses in -asn-db, written as extra columns")
+	fASNDB                = flag.String("asn-db", "", "MaxMind-format ASN database file, such as GeoLite2-ASN.mmdb, for -asn")
+	fProbeWildcards       = flag.Bool("probe-wildcards", false, "resolve wildcard names by substituting -probe-label for the *, written as an extra column")
+	fProbeLabel           = flag.String("probe-label", "wildcard-probe", "label -probe-wildcards substitutes for the * of wildcard names")
+	fSorted               = flag.Bool("sorted", false, "hold all results until the scan finishes and write them sorted, for stable output")
+	fCollapseNames        = flag.Bool("collapse-names", false, "merge the certificates found for each name of a domain, written with a certificate count column")
+	fFormat               = flag.String("format", "csv", "output format: csv, json, jsonl, edges, or protobuf")
+	fExcludeDomainsFile   = flag.String("exclude-domains-file", "", "read domains for -exclude-domain from this file, one per line")
+	fPretty               = flag.Bool("pretty", false, "indent -format json output")
+	fDryRun               = flag.Bool("dry-run", false, "print the domains that would be scanned, after normalization and exclusions, without scanning them")
+	fPageDelay            = flag.Duration("page-delay", 0, "time to wait between result pages for the same domain")
+	fIPsOnly              = flag.Bool("ips-only", false, "only write the sorted, unique addresses found, one per line, when the run finishes")
+	fNamesOnly            = flag.Bool("names-only", false, "only write the sorted, unique names found, one per line, without resolving them")
+	fIncludeWildcards     = flag.Bool("include-wildcards", false, "keep the *. of wildcard names with -names-only instead of stripping it")
+	fDNSRetries           = flag.Int("dns-retries", 0, "times to retry DNS lookups that fail with a temporary error")
+	fScanBuffer           = flag.Int("scan-buffer", 1000, "number of discovered names that can queue for resolution")
+	fResolveBuffer        = flag.Int("resolve-buffer", 100, "number of resolved names that can queue for output")
+	fDropCoveredWildcards = flag.Bool("drop-covered-wildcards", false, "leave out *.domain names when a name directly under domain was also found. Holds results until the scan finishes")
+	fNoSubdomains         = flag.Bool("no-subdomains", false, "don't scan subdomains of the input domains unless a domain's line says to")
+	fMaxRuntime           = flag.Duration("max-runtime", 0, "stop the run after this long, writing the results so far and exiting with status 124. 0 means no limit")
+	fDNSCacheTTL          = flag.Duration("dns-cache-ttl", 0, "cache DNS address lookups for this long. 0 disables the cache")
+	fCTHost               = flag.String("ct-host", "", "host, or base URL, to send certificate transparency requests to instead of the source's own")
+	fCTLang               = flag.String("ct-lang", ctscan.DefaultGoogleLang, "language to request from Google, as its hl parameter")
+	fStrict               = flag.Bool("strict", false, "stop with an error on an invalid input domain instead of skipping it")
+	fResolveWorkers       = flag.Int("resolve-workers", 0, "maximum DNS lookups running at once, independent of -resolvers. 0 has each resolver do its own lookups")
+	fSince                = flag.String("since", "", "only keep certificates issued since this long ago, like 720h, or this date, like 2021-01-31")
+	fFlushInterval        = flag.Duration("flush-interval", time.Second, "how often to flush buffered output. 0 flushes after every record")
+	fParseRetries         = flag.Int("parse-retries", 2, "how many times to fetch a Google results page again when its response is cut short or otherwise isn't valid JSON")
+	fConfig               = flag.String("config", "", "read flag settings from this file. Flags given on the command line take precedence")
+	fCAFile               = flag.String("ca-file", "", "also trust the PEM CA certificates in this file, such as an intercepting proxy's")
+	fInsecureSkipVerify   = flag.Bool("insecure-skip-verify", false, "don't verify TLS certificates. Only for getting through intercepting proxies")
+	fMaxDomains           = flag.Int("max-domains", 0, "only scan the first this many distinct input domains. 0 means no limit")
+	fContinueOnError      = flag.Bool("continue-on-error", false, "when a domain can't be scanned, write an error row for it and carry on instead of stopping the run")
+	fSplitByDomain        = flag.String("split-by-domain", "", "write each source domain's results to its own file in this directory instead of STDOUT")
+	fMetricsAddr          = flag.String("metrics-addr", "", "serve Prometheus metrics at /metrics on this address, like :9090, while the scan runs")
+	fRDAP                 = flag.Bool("rdap", false, "look up the registrar and registration date of each name's registrable domain with RDAP, written as extra columns")
+	fRDAPRate             = flag.Float64("rdap-rate", 1, "maximum RDAP queries per second, separate from -rate. 0 means no limit")
+	fRDAPURL              = flag.String("rdap-url", "", "RDAP server to query instead of the rdap.org bootstrap service")
+	fKnownNames           = flag.String("known-names", "", "file of names seen by earlier runs, one per line, for -new-only and -update-known")
+	fNewOnly              = flag.Bool("new-only", false, "only write names that aren't in the -known-names file")
+	fUpdateKnown          = flag.Bool("update-known", false, "add the names found that weren't in the -known-names file to it when the run finishes")
+	fCookieTimeout        = flag.Duration("cookie-timeout", 30*time.Second, "maximum time to wait for each attempt at fetching the Google cookie. 0 means no limit")
+	fCookieRetries        = flag.Int("cookie-retries", 2, "how many more times to try fetching the Google cookie after a network or server error")
+	fFailOnEmpty          = flag.Bool("fail-on-empty", false, "exit with status 5 if no records were found at all")
+	fStatus               = flag.Bool("status", false, "write a column saying whether each name resolved, had no addresses, or failed")
+	fStagger              = flag.Duration("stagger", 200*time.Millisecond, "delay between starting each scanner, plus up to half as much random jitter, so their first requests spread out. 0 starts them all at once")
+	fGzipOutput           = flag.Bool("gzip-output", false, "compress the output with gzip. On by default when -o ends in .gz")
+	fDebugRaw             = flag.Bool("debug-raw", false, "write the raw JSON each record was parsed from, for debugging. Google only, and verbose")
+	fAggregateValidity    = flag.Bool("aggregate-validity", false, "merge the certificates found for each name of a domain, written with columns for the earliest not before and latest not after among them")
+	fGroupWindow          = flag.Int("group-window", 0, "hold up to this many results so each source domain's are written together. 0 writes them as they arrive")
+	fProbeHTTP            = flag.Bool("probe-http", false, "request https://name/ for each resolved name, written as status code, Server header, and error columns")
+	fProbeHTTPTimeout     = flag.Duration("probe-http-timeout", ctscan.DefaultHTTPProbeTimeout, "time limit for each -probe-http request")
+	fProbeHTTPWorkers     = flag.Int("probe-http-workers", 10, "number of names -probe-http requests at once")
+	fAllCerts             = flag.Bool("all-certs", false, "write a result for every certificate a name appears on, not just the first, to see renewals and issuer changes")
+	fDomainTimeout        = flag.Duration("domain-timeout", 0, "time limit for scanning each domain across all of its pages. Results found before it are kept. 0 means no limit")
+	fDNSServers           stringList
+	fHeaders              stringList
+	fMatch                stringList
+	fExclude              stringList
+	fExcludeDomains       stringList
+	fIssuers              stringList
+	fResolveFilters       stringList
+	fExcludeIssuers       stringList
+)
+
+func init() {
+	flag.StringVar(&fOutput, "o", "", "write results to this file instead of STDOUT")
+	flag.StringVar(&fOutput, "output", "", "write results to this file instead of STDOUT")
+	flag.BoolVar(fNoSubdomains, "exact", false, "same as -no-subdomains: only scan certificates for the input domains themselves")
+	flag.Var(&fMatch, "match", "only keep names matching this regular expression, may be repeated")
+	flag.Var(&fExclude, "exclude", "drop names matching this regular expression, may be repeated")
+	flag.Var(&fIssuers, "issuer", "only keep names from certificates whose issuer matches this regular expression, may be repeated")
+	flag.Var(&fExcludeIssuers, "exclude-issuer", "drop names from certificates whose issuer matches this regular expression, may be repeated")
+	flag.Var(&fResolveFilters, "resolve-filter", "only resolve names matching this regular expression, may be repeated. Other names are still written, marked as not resolved")
+	flag.Var(&fExcludeDomains, "exclude-domain", "don't scan or output this domain or its subdomains, may be repeated")
+	flag.Var(&fHeaders, "header", "extra request header as name:value, may be repeated. Replaces a default header with the same name")
+	flag.Var(&fDNSServers, "dns-server", "DNS server host:port to resolve with, may be repeated. Defaults to the system resolver")
+}
+
+// stringList is a flag.Value that collects every use of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// Exit statuses, so scripts can tell failures apart. A run that finishes
+// cleanly exits with 0, even if it found nothing.
+const (
+	// exitError is for failures not covered below, like bad flags.
+	exitError = 1
+	// exitCookie means the Google cookie couldn't be fetched, at the start
+	// or when refreshing it partway through.
+	exitCookie = 2
+	// exitNetwork means a request couldn't reach its server.
+	exitNetwork = 3
+	// exitPartial means the run finished but some names failed to resolve
+	// for reasons other than not existing, so the results may be missing
+	// addresses, or with -continue-on-error, some domains couldn't be
+	// scanned.
+	exitPartial = 4
+	// exitEmpty means -fail-on-empty is set and scanning found nothing.
+	exitEmpty = 5
+	// exitTimeout means -max-runtime cut the run short. It's the same
+	// status timeout(1) uses.
+	exitTimeout = 124
 )
 
 func fatalIfError(err error, msg string) {
+	exitIfError(err, msg, exitError)
+}
+
+// exitIfError logs err and exits with code if err isn't nil.
+func exitIfError(err error, msg string, code int) {
+	if err != nil {
+		log.Print("error ", msg, ": ", err)
+		os.Exit(code)
+	}
+}
+
+// runErrorCode picks the exit status for an error that stopped a run.
+func runErrorCode(err error) int {
+	if ctscan.IsCookieError(err) {
+		return exitCookie
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return exitNetwork
+	}
+	return exitError
+}
+
+// brokenPipe reports whether err came from writing output after its reader
+// went away, like when piping into head.
+func brokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
+}
+
+// ipNetwork maps an -ip-version value to the network name used for
+// resolution.
+func ipNetwork(version string) (string, error) {
+	switch version {
+	case "any":
+		return "ip", nil
+	case "4":
+		return "ip4", nil
+	case "6":
+		return "ip6", nil
+	}
+	return "", fmt.Errorf("unknown IP version %q, expected any, 4, or 6", version)
+}
+
+// toUnicode converts a punycode name to Unicode for display, returning it
+// unchanged if it can't be converted.
+func toUnicode(name string) string {
+	u, err := idna.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+	return u
+}
+
+// hostURL turns a -ct-host value into a base URL. A bare host name or
+// host:port is assumed to use HTTPS.
+func hostURL(host string) string {
+	if strings.Contains(host, "://") {
+		return host
+	}
+	return "https://" + host
+}
+
+// newTransport returns an HTTP transport that trusts the PEM certificates in
+// caFile, if given, on top of the system's, and skips certificate
+// verification entirely if insecure is set.
+func newTransport(caFile string, insecure bool) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// parseSince converts a -since value, either a duration before now or a date
+// or time, to the time it means.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q isn't a duration, YYYY-MM-DD date, or RFC 3339 time", s)
+}
+
+// staggerDelay returns how long the scanner with index i waits before starting:
+// i times stagger, plus a random amount up to half of stagger. The first
+// scanner starts right away.
+func staggerDelay(i int, stagger time.Duration, jitter *rand.Rand) time.Duration {
+	if i == 0 || stagger <= 0 {
+		return 0
+	}
+	return time.Duration(i)*stagger + time.Duration(jitter.Int63n(int64(stagger/2)+1))
+}
+
+// parseHeaders converts "Name: value" strings to a map of headers.
+func parseHeaders(list []string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, h := range list {
+		i := strings.Index(h, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("header %q isn't in name:value form", h)
+		}
+		headers[http.CanonicalHeaderKey(strings.TrimSpace(h[:i]))] = strings.TrimSpace(h[i+1:])
+	}
+	return headers, nil
+}
+
+// filter starts a filter stage reading from in, returning its output. Once in
+// is closed and drained, the output is closed and the number of records
+// dropped is recorded in stats under name. Records for failed scans aren't
+// about a name, so they're always kept. Each dropped record is passed to drop.
+func filter(in <-chan ctscan.Record, stats *summary, name string, drop func(ctscan.Record), keep func(ctscan.Record) bool) <-chan ctscan.Record {
+	out := make(chan ctscan.Record)
+	dropped := new(int)
+	stats.dropped[name] = dropped
+	go func() {
+		defer close(out)
+		*dropped = ctscan.Filter(in, out, func(record ctscan.Record) bool {
+			if record.Status() == ctscan.StatusScanError || keep(record) {
+				return true
+			}
+			drop(record)
+			return false
+		})
+	}()
+	return out
+}
+
+// dropCoveredWildcards starts a stage that holds every record until in is
+// closed, then passes them along except for wildcard names like *.example.com
+// when a name directly under the same domain, like www.example.com, was also
+// found. The number dropped is recorded in stats, and each is passed to drop.
+func dropCoveredWildcards(in <-chan ctscan.Record, stats *summary, drop func(ctscan.Record)) <-chan ctscan.Record {
+	out := make(chan ctscan.Record)
+	dropped := new(int)
+	stats.dropped["wildcard"] = dropped
+	go func() {
+		defer close(out)
+		var records []ctscan.Record
+		covered := map[string]struct{}{}
+		for record := range in {
+			records = append(records, record)
+			name := strings.ToLower(record.Name)
+			if i := strings.Index(name, "."); i > 0 && ctscan.IsResolvable(name) {
+				covered[name[i+1:]] = struct{}{}
+			}
+		}
+		for _, record := range records {
+			name := strings.ToLower(record.Name)
+			if strings.HasPrefix(name, "*.") {
+				if _, present := covered[name[2:]]; present {
+					(*dropped)++
+					drop(record)
+					continue
+				}
+			}
+			out <- record
+		}
+	}()
+	return out
+}
+
+// compilePatterns compiles each of a flag's regular expressions.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+// matchesAny reports whether s matches any of the regular expressions.
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameKey is the form of a name used to match it against -known-names.
+func nameKey(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// appendKnownNames adds names to the end of a -known-names file, sorted,
+// creating it if needed.
+func appendKnownNames(path string, names map[string]struct{}) error {
+	sorted := sortedKeys(names)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = f
+	var gz *gzip.Writer
+	if strings.HasSuffix(path, ".gz") {
+		// a gzip file can hold several streams one after another, so the
+		// new names go in a stream of their own
+		gz = gzip.NewWriter(f)
+		out = gz
+	}
+	w := bufio.NewWriter(out)
+	for _, name := range sorted {
+		fmt.Fprintln(w, name)
+	}
+	err = w.Flush()
+	if gz != nil && err == nil {
+		err = gz.Close()
+	}
 	if err != nil {
-		log.Fatal("error ", msg, ": ", err)
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// dedupe starts a stage that passes along only the first record for each
+// name, returning its output. The others are passed to drop.
+func dedupe(in <-chan ctscan.Record, drop func(ctscan.Record)) <-chan ctscan.Record {
+	out := make(chan ctscan.Record)
+	seen := map[string]struct{}{}
+	go func() {
+		defer close(out)
+		ctscan.Filter(in, out, func(record ctscan.Record) bool {
+			if record.Status() == ctscan.StatusScanError {
+				return true
+			}
+			if _, present := seen[record.Name]; present {
+				drop(record)
+				return false
+			}
+			seen[record.Name] = struct{}{}
+			return true
+		})
+	}()
+	return out
+}
+
+// sorted starts a stage that collects every record until in is closed, then
+// sends them out ordered by source domain, name, and address.
+func sorted(in <-chan ctscan.Record) <-chan ctscan.Record {
+	out := make(chan ctscan.Record)
+	go func() {
+		defer close(out)
+		var records []ctscan.Record
+		for record := range in {
+			sort.Strings(record.Addrs)
+			records = append(records, record)
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			a, b := records[i], records[j]
+			if a.From != b.From {
+				return a.From < b.From
+			}
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+			return strings.Join(a.Addrs, ",") < strings.Join(b.Addrs, ",")
+		})
+		for _, record := range records {
+			out <- record
+		}
+	}()
+	return out
+}
+
+// groupIdle is how long grouped waits without new records before writing out
+// everything it holds, so a lull in the scan doesn't hold up output.
+const groupIdle = time.Second
+
+// domainProgress follows each source domain's records from the scanner to
+// the grouped stage, so it can tell when a domain has no more to come.
+type domainProgress struct {
+	lock sync.Mutex
+	// expected is how many records of each domain the scanner has finished
+	// sending, less those dropped on the way
+	expected map[string]int
+	// dropped counts records dropped before their domain was finished
+	dropped map[string]int
+	// updates has each domain that may now be complete, when there's room
+	updates chan string
+}
+
+func newDomainProgress() *domainProgress {
+	return &domainProgress{
+		expected: map[string]int{},
+		dropped:  map[string]int{},
+		updates:  make(chan string, 100),
+	}
+}
+
+// done is the scanner's OnDone callback.
+func (p *domainProgress) done(domain string, records int) {
+	p.lock.Lock()
+	p.expected[domain] = records - p.dropped[domain]
+	delete(p.dropped, domain)
+	p.lock.Unlock()
+	p.update(domain)
+}
+
+// drop counts a record dropped before it reached the grouped stage.
+func (p *domainProgress) drop(record ctscan.Record) {
+	p.lock.Lock()
+	_, finished := p.expected[record.From]
+	if finished {
+		p.expected[record.From]--
+	} else {
+		p.dropped[record.From]++
+	}
+	p.lock.Unlock()
+	if finished {
+		// the dropped record may have been the last one outstanding
+		p.update(record.From)
+	}
+}
+
+// update tells grouped to check on a domain.
+func (p *domainProgress) update(domain string) {
+	select {
+	case p.updates <- domain:
+	default:
+		// grouped is behind, and falls back on its window and timer
+	}
+}
+
+// complete reports whether received is all of a domain's records, and stops
+// following the domain if it is.
+func (p *domainProgress) complete(domain string, received int) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	expected, finished := p.expected[domain]
+	if !finished || received < expected {
+		return false
+	}
+	delete(p.expected, domain)
+	return true
+}
+
+// grouped starts a stage that holds up to window records, gathered by source
+// domain, so each domain's records come out together. A domain is sent out as
+// soon as progress shows all of its records have arrived. Otherwise, when the
+// window fills, the domain that's been held longest is sent out whole, and
+// everything held is sent when in is closed or has been idle for groupIdle,
+// so a domain's records can still be split into several groups.
+func grouped(in <-chan ctscan.Record, window int, progress *domainProgress) <-chan ctscan.Record {
+	out := make(chan ctscan.Record)
+	go func() {
+		defer close(out)
+		groups := map[string][]ctscan.Record{}
+		// order holds the domains being held, by when their first record came
+		var order []string
+		held := 0
+		// received counts each unfinished domain's records, including those
+		// already sent on in an earlier group
+		received := map[string]int{}
+		send := func(from string) {
+			for _, record := range groups[from] {
+				out <- record
+			}
+			held -= len(groups[from])
+			delete(groups, from)
+		}
+		sendOldest := func() {
+			from := order[0]
+			order = order[1:]
+			send(from)
+		}
+		sendIfComplete := func(from string) {
+			if !progress.complete(from, received[from]) {
+				return
+			}
+			delete(received, from)
+			if _, present := groups[from]; !present {
+				return
+			}
+			for i, domain := range order {
+				if domain == from {
+					order = append(order[:i], order[i+1:]...)
+					break
+				}
+			}
+			send(from)
+		}
+
+		ticker := time.NewTicker(groupIdle)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case record, ok := <-in:
+				if !ok {
+					for len(order) > 0 {
+						sendOldest()
+					}
+					return
+				}
+				last = time.Now()
+				if _, present := groups[record.From]; !present {
+					order = append(order, record.From)
+				}
+				groups[record.From] = append(groups[record.From], record)
+				held++
+				received[record.From]++
+				sendIfComplete(record.From)
+				for held >= window {
+					sendOldest()
+				}
+			case from := <-progress.updates:
+				sendIfComplete(from)
+			case <-ticker.C:
+				if time.Since(last) < groupIdle {
+					continue
+				}
+				for len(order) > 0 {
+					sendOldest()
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// unresolved reports whether a record's name definitively doesn't resolve,
+// either because it doesn't exist or because it has no addresses. Names that
+// couldn't be looked up and names that aren't resolvable at all don't count.
+func unresolved(record ctscan.Record) bool {
+	if !ctscan.IsResolvable(record.Name) {
+		return false
+	}
+	if record.Err != nil {
+		return ctscan.IsNotFound(record.Err)
+	}
+	return len(record.Addrs) == 0 && !record.PrivateOnly && !record.Skipped
+}
+
+// reportProgress prints the pipeline's counters to STDERR every interval until
+// the returned function is called.
+func reportProgress(interval time.Duration, scanner *ctscan.Scanner, resolver *ctscan.Resolver) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintf(os.Stderr, "progress: %d domains scanned, %d records found, %d names resolved\n",
+					scanner.Completed(), scanner.Records(), resolver.Resolved())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
 	}
 }
 
 func main() {
 	flag.Parse()
+	fatalIfError(applyEnv(), "reading environment")
+	if *fConfig != "" {
+		fatalIfError(applyConfig(*fConfig), "reading -config")
+	}
+	// report writes to a closed pipe as errors instead of being killed, so
+	// the run can be wound down
+	signal.Ignore(syscall.SIGPIPE)
+	stats := summary{start: time.Now(), dropped: map[string]*int{}}
+
+	level, err := ctscan.ParseLevel(*fLogLevel)
+	fatalIfError(err, "parsing -log-level")
+	logger := ctscan.NewLogger(os.Stderr, level)
+
+	network, err := ipNetwork(*fIPVersion)
+	fatalIfError(err, "parsing -ip-version")
 
 	// Need an auth cookie for requests. These aren't persisted to disk
 	jar, err := cookiejar.New(nil)
 	fatalIfError(err, "creating cookie jar")
+	transport, err := newTransport(*fCAFile, *fInsecureSkipVerify)
+	fatalIfError(err, "setting up TLS")
+	if *fInsecureSkipVerify {
+		log.Print("WARNING: -insecure-skip-verify is set, TLS certificates are not being checked and responses could come from anyone")
+	}
+	stats.requests = newRequestCounter(transport)
 	client := &http.Client{
-		Jar: jar,
+		Jar:       jar,
+		Transport: stats.requests,
+	}
+
+	matches, err := compilePatterns(fMatch)
+	fatalIfError(err, "parsing -match")
+	excludes, err := compilePatterns(fExclude)
+	fatalIfError(err, "parsing -exclude")
+	issuers, err := compilePatterns(fIssuers)
+	fatalIfError(err, "parsing -issuer")
+	excludeIssuers, err := compilePatterns(fExcludeIssuers)
+	fatalIfError(err, "parsing -exclude-issuer")
+	resolveFilters, err := compilePatterns(fResolveFilters)
+	fatalIfError(err, "parsing -resolve-filter")
+
+	var excluded *ctscan.Scope
+	if len(fExcludeDomains) > 0 || *fExcludeDomainsFile != "" {
+		domains := fExcludeDomains
+		if *fExcludeDomainsFile != "" {
+			fromFile, err := readDomainsFile(*fExcludeDomainsFile)
+			fatalIfError(err, "reading -exclude-domains-file")
+			domains = append(domains, fromFile...)
+		}
+		excluded = ctscan.NewScope()
+		for _, domain := range domains {
+			if !*fNoIDN {
+				if ascii, err := idna.ToASCII(domain); err == nil {
+					domain = ascii
+				}
+			}
+			excluded.Add(domain)
+		}
+	}
+
+	if (*fNewOnly || *fUpdateKnown) && *fKnownNames == "" {
+		log.Fatal("-new-only and -update-known need a -known-names file")
+	}
+	known := map[string]struct{}{}
+	if *fKnownNames != "" {
+		names, err := readDomainsFile(*fKnownNames)
+		if err != nil && !os.IsNotExist(err) {
+			// a missing file is a first run, with nothing known yet
+			fatalIfError(err, "reading -known-names")
+		}
+		for _, name := range names {
+			known[nameKey(name)] = struct{}{}
+		}
+	}
+
+	switch *fFormat {
+	case "csv", "json", "jsonl", "edges", "protobuf":
+	default:
+		log.Fatalf("unknown -format %q, expected csv, json, jsonl, edges, or protobuf", *fFormat)
+	}
+	outColumns := defaultColumns()
+	if *fColumns != "" {
+		outColumns, err = ctscan.ParseColumns(*fColumns)
+		fatalIfError(err, "parsing -columns")
+		if *fFormat == "edges" || *fFormat == "protobuf" {
+			log.Fatalf("-columns doesn't apply to -format %s", *fFormat)
+		}
+	}
+	var asnDB *ctscan.ASNDB
+	if hasColumn(outColumns, "asn") || hasColumn(outColumns, "asn_org") {
+		if *fASNDB == "" {
+			log.Fatal("-asn needs an -asn-db database")
+		}
+		asnDB, err = ctscan.OpenASNDB(*fASNDB)
+		fatalIfError(err, "opening -asn-db")
 	}
 
-	fatalIfError(getGoogleCookie(client), "getting google cookie")
+	headers, err := parseHeaders(fHeaders)
+	fatalIfError(err, "parsing -header")
+	if *fUserAgent != "" {
+		headers["User-Agent"] = *fUserAgent
+	}
+
+	var since time.Time
+	if *fSince != "" {
+		since, err = parseSince(*fSince, time.Now())
+		fatalIfError(err, "parsing -since")
+		logger.Infof("keeping certificates issued since %s, filtered client-side", since.Format(time.RFC3339))
+	}
+
+	var limiter *rate.Limiter
+	if *fRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(*fRate), 1)
+	}
+
+	var source ctscan.Source
+	switch *fSource {
+	case "google":
+		google := ctscan.NewGoogleSource(client, *fMaxPages)
+		if *fCTHost != "" {
+			google.BaseURL = hostURL(*fCTHost)
+		}
+		google.Lang = *fCTLang
+		google.Log = logger
+		google.Headers = headers
+		google.Limiter = limiter
+		google.MaxRecords = *fMaxRecords
+		google.PageDelay = *fPageDelay
+		google.ParseRetries = *fParseRetries
+		google.KeepRaw = *fDebugRaw || hasColumn(outColumns, "raw")
+		google.Since = since
+		google.CookieTimeout = *fCookieTimeout
+		google.CookieRetries = *fCookieRetries
+		if !*fDryRun {
+			exitIfError(google.GetCookie(), "getting google cookie", exitCookie)
+		}
+		source = google
+	case "crtsh":
+		crtsh := ctscan.NewCrtshSource(client)
+		if *fCTHost != "" {
+			crtsh.BaseURL = hostURL(*fCTHost)
+		}
+		crtsh.Log = logger
+		crtsh.Headers = headers
+		crtsh.Limiter = limiter
+		crtsh.MaxRecords = *fMaxRecords
+		crtsh.Since = since
+		source = crtsh
+	default:
+		log.Fatalf("unknown -source %q, expected google or crtsh", *fSource)
+	}
 
-	scanner := Scanner{
-		client:   client,
-		maxPages: *fMaxPages,
-		lock:     &sync.Mutex{},
-		scanned:  map[string]struct{}{},
-		in:       make(chan string),
-		out:      make(chan Record),
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// -max-runtime bounds every stage of the pipeline. Each stage still
+	// running when it's reached stops and passes on what it has, so stages
+	// that hold results until the end, like -sorted, still write theirs. The
+	// run only counts as cut short if a stage was still running; one whose
+	// stages all finished in time is complete even if writing takes longer.
+	runCtx := ctx
+	cancelRun := func() {}
+	if *fMaxRuntime > 0 {
+		runCtx, cancelRun = context.WithTimeout(ctx, *fMaxRuntime)
+		defer cancelRun()
+	}
+	var cutShort atomic.Bool
+	// stageDone is called as each stage finishes, to note whether the
+	// deadline stopped it
+	stageDone := func() {
+		if runCtx.Err() == context.DeadlineExceeded {
+			cutShort.Store(true)
+		}
 	}
 
+	// Domains come from the command line and -domains-file. STDIN is only
+	// read when neither is given. Either can be gzipped
+	var inputs []io.Reader
+	if flag.NArg() > 0 {
+		inputs = append(inputs, strings.NewReader(strings.Join(flag.Args(), "\n")+"\n"))
+	}
+	if *fDomainsFile != "" {
+		f, err := os.Open(*fDomainsFile)
+		fatalIfError(err, "opening domains file")
+		defer f.Close()
+		r, err := decompress(f)
+		fatalIfError(err, "reading domains file")
+		inputs = append(inputs, r)
+	}
+	if len(inputs) == 0 {
+		r, err := decompress(os.Stdin)
+		fatalIfError(err, "reading STDIN")
+		inputs = append(inputs, r)
+	}
+	input := io.MultiReader(inputs...)
+	domains := make(chan string)
+	if *fScanBuffer < 0 || *fResolveBuffer < 0 {
+		log.Fatal("-scan-buffer and -resolve-buffer can't be negative")
+	}
+	// buffering lets the scanners move on to the next domain while the
+	// resolvers are still working through the last one's names, and the
+	// resolvers keep going while output is being written
+	found := make(chan ctscan.Record, *fScanBuffer)
+	resolved := make(chan ctscan.Record, *fResolveBuffer)
+
+	scanner := ctscan.NewScanner(source)
+	scanner.IDN = !*fNoIDN
+	scanner.CollapseNames = *fCollapseNames || *fAggregateValidity
+	scanner.DomainTimeout = *fDomainTimeout
+	scanner.ContinueOnError = *fContinueOnError
+	scanner.Subdomains = !*fNoSubdomains
+	scanner.Strict = *fStrict
+	scanner.Log = logger
+	scanner.Exclude = excluded
+	scanner.MaxDomains = *fMaxDomains
+	if *fRecursive {
+		scanner.MaxDepth = *fMaxDepth
+	}
+	if *fDryRun {
+		// list what would be scanned and stop before any requests are made
+		go func() {
+			err := feedDomains(runCtx, input, domains, scanner.LimitReached)
+			close(domains)
+			fatalIfError(err, "reading domains")
+		}()
+		err := scanner.Plan(domains, func(domain string) {
+			fmt.Println(domain)
+		})
+		fatalIfError(err, "reading domains")
+		return
+	}
+	if *fResume && *fCheckpoint == "" {
+		log.Fatal("-resume requires -checkpoint")
+	}
+	if *fCheckpoint != "" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		if *fResume {
+			f, err := os.Open(*fCheckpoint)
+			if err == nil {
+				done, err := ctscan.ReadCheckpoint(f)
+				f.Close()
+				fatalIfError(err, "reading checkpoint")
+				scanner.Skip(done...)
+				logger.Infof("resuming, skipping %d domains from checkpoint", len(done))
+			} else if !os.IsNotExist(err) {
+				fatalIfError(err, "opening checkpoint")
+			}
+		} else {
+			// starting over, forget what was done before
+			flags |= os.O_TRUNC
+		}
+		f, err := os.OpenFile(*fCheckpoint, flags, 0644)
+		fatalIfError(err, "opening checkpoint")
+		defer f.Close()
+		scanner.Checkpoint = f
+	}
 	scanners := errgroup.Group{}
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for i := 0; i < *fScanners; i++ {
-		// Start up multiple scanners
-		scanners.Go(scanner.ScanStream)
+		// Start up multiple scanners, staggered so they don't all make their
+		// first requests at once
+		delay := staggerDelay(i, *fStagger, jitter)
+		scanners.Go(func() error {
+			if delay > 0 {
+				t := time.NewTimer(delay)
+				defer t.Stop()
+				select {
+				case <-t.C:
+				case <-runCtx.Done():
+					return runCtx.Err()
+				}
+			}
+			return scanner.ScanStream(runCtx, domains, found)
+		})
 	}
 
-	resolver := Resolver{
-		in:       scanner.out,
-		out:      make(chan Record),
-		lock:     &sync.Mutex{},
-		resolved: map[string]struct{}{},
+	// -group-window follows each domain's records through the pipeline, so
+	// a domain can be written as soon as all of its records are in. Records
+	// dropped on the way are reported to it, and to the scanner for
+	// -checkpoint.
+	var progress *domainProgress
+	if !*fSorted && *fGroupWindow > 0 {
+		progress = newDomainProgress()
+		scanner.OnDone = progress.done
+	}
+	drop := func(record ctscan.Record) {
+		scanner.Drop(record)
+		if progress != nil {
+			progress.drop(record)
+		}
+	}
+
+	// Filters sit between the scanners and resolvers so dropped names aren't
+	// resolved
+	var toResolve <-chan ctscan.Record = found
+	if *fInScopeOnly {
+		scope := ctscan.NewScope()
+		scanner.Scope = scope
+		toResolve = filter(toResolve, &stats, "scope", drop, func(record ctscan.Record) bool {
+			return scope.Contains(record.Name)
+		})
+	}
+	if excluded != nil {
+		toResolve = filter(toResolve, &stats, "excluded", drop, func(record ctscan.Record) bool {
+			return !excluded.Contains(record.Name)
+		})
+	}
+	if len(matches) > 0 || len(excludes) > 0 {
+		toResolve = filter(toResolve, &stats, "pattern", drop, func(record ctscan.Record) bool {
+			return (len(matches) == 0 || matchesAny(matches, record.Name)) && !matchesAny(excludes, record.Name)
+		})
+	}
+	if len(issuers) > 0 || len(excludeIssuers) > 0 {
+		// the organization is checked too since Google only gives the
+		// issuer's common name
+		issuerMatches := func(res []*regexp.Regexp, record ctscan.Record) bool {
+			return matchesAny(res, record.Issuer) || (record.IssuerOrg != "" && matchesAny(res, record.IssuerOrg))
+		}
+		toResolve = filter(toResolve, &stats, "issuer", drop, func(record ctscan.Record) bool {
+			return (len(issuers) == 0 || issuerMatches(issuers, record)) && !issuerMatches(excludeIssuers, record)
+		})
+	}
+	// names found this run that weren't known before
+	newNames := map[string]struct{}{}
+	if *fNewOnly || *fUpdateKnown {
+		toResolve = filter(toResolve, &stats, "known", drop, func(record ctscan.Record) bool {
+			key := nameKey(record.Name)
+			if _, present := known[key]; present {
+				return !*fNewOnly
+			}
+			newNames[key] = struct{}{}
+			return true
+		})
+	}
+
+	resolver := ctscan.NewResolver()
+	resolver.Network = network
+	resolver.DNS = ctscan.NewDNSResolver(fDNSServers)
+	resolver.Timeout = *fDNSTimeout
+	resolver.Retries = *fDNSRetries
+	resolver.Workers = *fResolveWorkers
+	resolver.CacheTTL = *fDNSCacheTTL
+	if *fDNSCacheTTL > 0 {
+		stats.cache = resolver.CacheStats
+	}
+	resolver.Log = logger
+	resolver.PTR = hasColumn(outColumns, "ptr")
+	resolver.CNAME = hasColumn(outColumns, "cname")
+	resolver.MX = hasColumn(outColumns, "mx")
+	resolver.TXT = hasColumn(outColumns, "txt")
+	resolver.PublicOnly = *fPublicOnly
+	resolver.MaxNames = *fMaxNames
+	resolver.AllRecords = *fAllCerts
+	resolver.OnDrop = drop
+	if len(resolveFilters) > 0 {
+		resolver.Filter = func(name string) bool {
+			return matchesAny(resolveFilters, name)
+		}
+	}
+	resolver.ASN = asnDB
+	if *fProbeWildcards {
+		resolver.WildcardProbe = *fProbeLabel
 	}
 	resolvers := errgroup.Group{}
-	for i := 0; i < *fResolvers; i++ {
-		// Start up multiple resolvers
-		resolvers.Go(resolver.Resolve)
+	var results <-chan ctscan.Record = resolved
+	if *fNoResolve || *fNamesOnly {
+		// skip resolution, passing each name through once just as the
+		// resolvers would
+		results = toResolve
+		if !*fAllCerts {
+			results = dedupe(toResolve, drop)
+		}
+	} else {
+		for i := 0; i < *fResolvers; i++ {
+			// Start up multiple resolvers
+			resolvers.Go(func() error {
+				return resolver.Resolve(runCtx, toResolve, resolved)
+			})
+		}
+	}
+	if hasColumn(outColumns, "registrar") || hasColumn(outColumns, "registered") || hasColumn(outColumns, "rdap_error") {
+		rdap := ctscan.NewRDAPClient(&http.Client{Transport: transport})
+		if *fRDAPURL != "" {
+			rdap.BaseURL = hostURL(*fRDAPURL)
+		}
+		rdap.Log = logger
+		if *fRDAPRate > 0 {
+			rdap.Limiter = rate.NewLimiter(rate.Limit(*fRDAPRate), 1)
+		}
+		in := results
+		enriched := make(chan ctscan.Record)
+		go func() {
+			defer close(enriched)
+			// it only fails when -max-runtime is reached
+			rdap.Enrich(runCtx, in, enriched)
+			stageDone()
+		}()
+		results = enriched
+	}
+	if hasColumn(outColumns, "http_status") || hasColumn(outColumns, "http_server") || hasColumn(outColumns, "http_error") {
+		probeTransport := transport.Clone()
+		// every name is a different host, so idle connections are rarely
+		// reused
+		probeTransport.DisableKeepAlives = true
+		stats.probes = newRequestCounter(probeTransport)
+		prober := ctscan.NewHTTPProber(&http.Client{Transport: stats.probes})
+		prober.Timeout = *fProbeHTTPTimeout
+		prober.Workers = *fProbeHTTPWorkers
+		prober.Log = logger
+		in := results
+		probed := make(chan ctscan.Record)
+		go func() {
+			defer close(probed)
+			// it only fails when -max-runtime is reached
+			prober.Enrich(runCtx, in, probed)
+			stageDone()
+		}()
+		results = probed
+	}
+	if *fDropCoveredWildcards {
+		results = dropCoveredWildcards(results, &stats, drop)
+	}
+	if *fSorted {
+		results = sorted(results)
+	} else if *fGroupWindow > 0 {
+		results = grouped(results, *fGroupWindow, progress)
 	}
 
+	// Errors from the background stages are reported here so the output can
+	// be flushed before exiting
+	failed := make(chan error, 2)
+
 	go func() {
-		// when we've received everything from STDIN, close the input channel
-		// to the scanners to signal no more work
-		defer close(scanner.in)
-		lineScanner := bufio.NewScanner(os.Stdin)
-		for lineScanner.Scan() {
-			// read lines from standard in
-			line := lineScanner.Text()
-			line = strings.TrimSpace(line)
-			if line == "" || line[0] == '#' {
-				// skip empty lines and comments
-				continue
-			}
-			scanner.in <- line
+		// when we've received all the input, close the input channel to the
+		// scanners to signal no more work
+		defer close(domains)
+		err := feedDomains(runCtx, input, domains, scanner.LimitReached)
+		stageDone()
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			failed <- fmt.Errorf("reading domains: %w", err)
 		}
 	}()
 
 	go func() {
-		// wait for the scanners to finish
-		fatalIfError(scanners.Wait(), "in scanner")
-		// close scanner.out/resolver.in to signal no more resolver work
-		close(scanner.out)
+		// wait for the scanners to finish. Running out of -max-runtime stops
+		// them with an error, but the results so far are still wanted
+		err := scanners.Wait()
+		stageDone()
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			failed <- fmt.Errorf("in scanner: %w", err)
+			return
+		}
+		// close the scanners' output to signal no more resolver work
+		close(found)
 		// Wait for the resolvers to finish
-		fatalIfError(resolvers.Wait(), "in resolver")
-		// close resolver.out to signal no more output work
-		close(resolver.out)
+		err = resolvers.Wait()
+		stageDone()
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			failed <- fmt.Errorf("in resolver: %w", err)
+			return
+		}
+		// close the resolvers' output to signal no more output work
+		close(resolved)
 	}()
 
-	w := csv.NewWriter(os.Stdout)
-	for record := range resolver.out {
-		var row []string
-		if record.Err != nil {
-			w.Write([]string{
-				record.From,
-				record.Name,
-				"",
-				record.Err.Error(),
-			})
-		} else {
-			row = []string{
-				record.From,
-				record.Name,
-				"",
-				"",
+	var out io.Writer = os.Stdout
+	var outFile *os.File
+	if fOutput != "" {
+		outFile, err = os.Create(fOutput)
+		fatalIfError(err, "creating output file")
+		out = outFile
+	}
+	// -sqlite and -split-by-domain write elsewhere, so there's nothing to
+	// compress, and an empty gzip stream would be left on out
+	toOut := *fSQLite == "" && (*fIPsOnly || *fNamesOnly || *fSplitByDomain == "")
+	var gz *gzip.Writer
+	if toOut && (*fGzipOutput || strings.HasSuffix(fOutput, ".gz")) {
+		gz = gzip.NewWriter(out)
+		out = gz
+	}
+
+	var output ctscan.Output
+	if *fSQLite != "" {
+		output, err = newSQLiteWriter(*fSQLite)
+		fatalIfError(err, "opening SQLite database")
+	} else if *fIPsOnly {
+		output = newIPsOutput(out)
+	} else if *fNamesOnly {
+		output = newNamesOutput(out, *fIncludeWildcards)
+	} else if *fSplitByDomain != "" {
+		output, err = newSplitOutput(*fSplitByDomain, *fFormat, outColumns)
+		fatalIfError(err, "creating -split-by-domain directory")
+	} else {
+		output = newOutput(*fFormat, out, outColumns)
+	}
+
+	stopProgress := func() {}
+	if *fProgress > 0 {
+		stopProgress = reportProgress(*fProgress, scanner, resolver)
+	}
+	if *fMetricsAddr != "" {
+		err := serveMetrics(ctx, *fMetricsAddr, scanner, resolver, stats.requests)
+		fatalIfError(err, "starting -metrics-addr server")
+	}
+
+	// Flush buffered output now and then so streaming consumers see records
+	// promptly. With no interval, every record is flushed as it's written.
+	var flushTick <-chan time.Time
+	if *fFlushInterval > 0 {
+		ticker := time.NewTicker(*fFlushInterval)
+		defer ticker.Stop()
+		flushTick = ticker.C
+	}
+
+	// With -checkpoint, records are released back to the scanner once they've
+	// been flushed, so a domain isn't checkpointed before its results are
+	// out. Only the source domain is needed for that. The compressor and
+	// -ips-only and -names-only hold everything until they're closed, so
+	// their records are released after that.
+	track := *fCheckpoint != ""
+	holdAll := gz != nil || *fIPsOnly || *fNamesOnly
+	var unreleased []ctscan.Record
+	flush := func() error {
+		if err := output.Flush(); err != nil {
+			return fmt.Errorf("writing output: %w", err)
+		}
+		if holdAll {
+			return nil
+		}
+		n := len(unreleased)
+		if p, ok := output.(pendingOutput); ok {
+			// the latest records may still be held back
+			n -= p.Pending()
+		}
+		if n <= 0 {
+			return nil
+		}
+		err := scanner.Release(unreleased[:n]...)
+		unreleased = append(unreleased[:0], unreleased[n:]...)
+		return err
+	}
+
+	var runErr error
+	for done := false; !done; {
+		select {
+		case record, ok := <-results:
+			if !ok {
+				done = true
+				break
+			}
+			from := record.From
+			if *fUnicode {
+				record.From = toUnicode(record.From)
+				record.Name = toUnicode(record.Name)
+			}
+			stats.add(record)
+			if *fUnresolvedOnly && !unresolved(record) {
+				scanner.Drop(ctscan.Record{From: from})
+				continue
+			}
+			if err := output.Write(record); err != nil {
+				runErr = fmt.Errorf("writing output: %w", err)
+				done = true
+				break
+			}
+			if track {
+				unreleased = append(unreleased, ctscan.Record{From: from})
 			}
-			for _, addr := range record.Addrs {
-				row[2] = addr
-				w.Write(row)
+			if flushTick == nil {
+				if err := flush(); err != nil {
+					runErr = err
+					done = true
+				}
 			}
+		case <-flushTick:
+			if err := flush(); err != nil {
+				runErr = err
+				done = true
+			}
+		case runErr = <-failed:
+			done = true
+		}
+	}
+	stopProgress()
+	// the pipeline is done with, so stop the -max-runtime timer
+	cancelRun()
+	// the final flush, which also catches write errors from the last records
+	if err := flush(); err != nil && runErr == nil {
+		runErr = err
+	}
+	if brokenPipe(runErr) {
+		// nobody is reading any more, so stop the scan rather than spending
+		// requests on results that can't be written
+		cancel()
+		logger.Infof("output closed, stopping")
+		os.Exit(0)
+	}
+	if closer, ok := output.(io.Closer); ok {
+		err := closer.Close()
+		if brokenPipe(err) {
+			os.Exit(0)
+		}
+		fatalIfError(err, "closing output")
+	}
+	if gz != nil {
+		// writes the end of the stream, without which it's truncated
+		err := gz.Close()
+		if brokenPipe(err) {
+			os.Exit(0)
 		}
+		fatalIfError(err, "finishing compressed output")
+	}
+	if outFile != nil {
+		fatalIfError(outFile.Close(), "closing output file")
+	}
+	// everything written is out now
+	fatalIfError(scanner.Release(unreleased...), "finishing run")
+	if *fUpdateKnown && runErr == nil {
+		err := appendKnownNames(*fKnownNames, newNames)
+		fatalIfError(err, "updating -known-names")
+	}
+	if *fSummary {
+		stats.write(os.Stderr, scanner.Scanned())
+	}
+	if cutShort.Load() {
+		log.Printf("stopped after -max-runtime of %s, results are incomplete", *fMaxRuntime)
+		os.Exit(exitTimeout)
+	}
+	exitIfError(runErr, "running scan", runErrorCode(runErr))
+	if *fFailOnEmpty && scanner.Records() == 0 {
+		log.Print("no records were found")
+		os.Exit(exitEmpty)
+	}
+	if stats.scanErrors > 0 {
+		log.Printf("%d domains failed to scan", stats.scanErrors)
+		os.Exit(exitPartial)
+	}
+	if stats.timedOut > 0 {
+		log.Printf("%d domains hit -domain-timeout, results are incomplete", stats.timedOut)
+		os.Exit(exitPartial)
+	}
+	if stats.dnsTimeout+stats.otherErr > 0 {
+		log.Printf("%d names failed to resolve", stats.dnsTimeout+stats.otherErr)
+		os.Exit(exitPartial)
 	}
-	w.Flush()
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jasonmf/mfctscan/ctscan"
+)
+
+func TestGroupedSendsFinishedDomains(t *testing.T) {
+	in := make(chan ctscan.Record)
+	progress := newDomainProgress()
+	out := grouped(in, 100, progress)
+	defer close(in)
+
+	in <- ctscan.Record{From: "a.example", Name: "www.a.example"}
+	in <- ctscan.Record{From: "b.example", Name: "www.b.example"}
+	// a.example's third record is dropped on the way, after its scan is done
+	progress.done("a.example", 3)
+	in <- ctscan.Record{From: "a.example", Name: "mail.a.example"}
+	progress.drop(ctscan.Record{From: "a.example", Name: "www.a.example"})
+
+	var got []string
+	timeout := time.After(groupIdle / 2)
+	for len(got) < 2 {
+		select {
+		case record := <-out:
+			if record.From != "a.example" {
+				t.Fatalf("got a record from %s before the idle timeout, want only a.example's", record.From)
+			}
+			got = append(got, record.Name)
+		case <-timeout:
+			t.Fatalf("got %q before the idle timeout, want a.example's two records", got)
+		}
+	}
+	if got[0] != "www.a.example" || got[1] != "mail.a.example" {
+		t.Errorf("got %q, want a.example's records in order", got)
+	}
+
+	// b.example isn't finished, so it's held until the idle timeout
+	select {
+	case record := <-out:
+		t.Errorf("got %s from %s before b.example was finished", record.Name, record.From)
+	case <-time.After(groupIdle / 2):
+	}
+}
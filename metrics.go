@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+
+	"github.com/jasonmf/mfctscan/ctscan"
+)
+
+// serveMetrics serves the progress of a run in the Prometheus text format at
+// /metrics on addr, until ctx is done. The counters are read when scraped, so
+// nothing is tracked when it isn't running.
+func serveMetrics(ctx context.Context, addr string, scanner *ctscan.Scanner, resolver *ctscan.Resolver, requests *requestCounter) error {
+	// listen first so a bad address is reported before the run starts
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, scanner, resolver, requests)
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	return nil
+}
+
+// writeMetrics writes the current value of each metric.
+func writeMetrics(w io.Writer, scanner *ctscan.Scanner, resolver *ctscan.Resolver, requests *requestCounter) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("mfctscan_domains_scanned_total", "counter", "Domains that have finished scanning.")
+	fmt.Fprintf(w, "mfctscan_domains_scanned_total %d\n", scanner.Completed())
+	metric("mfctscan_domains_failed_total", "counter", "Domains whose scans failed.")
+	fmt.Fprintf(w, "mfctscan_domains_failed_total %d\n", scanner.Failed())
+	metric("mfctscan_records_total", "counter", "Records found by scanning.")
+	fmt.Fprintf(w, "mfctscan_records_total %d\n", scanner.Records())
+	metric("mfctscan_dns_lookups_total", "counter", "Names looked up in DNS.")
+	fmt.Fprintf(w, "mfctscan_dns_lookups_total %d\n", resolver.Resolved())
+
+	notFound, timeouts, other := resolver.Errors()
+	metric("mfctscan_dns_errors_total", "counter", "Failed DNS lookups, by type.")
+	fmt.Fprintf(w, "mfctscan_dns_errors_total{type=\"nxdomain\"} %d\n", notFound)
+	fmt.Fprintf(w, "mfctscan_dns_errors_total{type=\"timeout\"} %d\n", timeouts)
+	fmt.Fprintf(w, "mfctscan_dns_errors_total{type=\"other\"} %d\n", other)
+
+	_, byStatus, failed := requests.counts()
+	metric("mfctscan_http_requests_total", "counter", "HTTP requests to the certificate transparency source, by response status.")
+	for _, status := range sortedKeys(byStatus) {
+		fmt.Fprintf(w, "mfctscan_http_requests_total{status=\"%d\"} %d\n", status, byStatus[status])
+	}
+	fmt.Fprintf(w, "mfctscan_http_requests_total{status=\"none\"} %d\n", failed)
+
+	metric("mfctscan_scans_in_flight", "gauge", "Domains being looked up in the source right now.")
+	fmt.Fprintf(w, "mfctscan_scans_in_flight %d\n", scanner.Active())
+	metric("mfctscan_dns_lookups_in_flight", "gauge", "Names being looked up in DNS right now.")
+	fmt.Fprintf(w, "mfctscan_dns_lookups_in_flight %d\n", resolver.Active())
+	metric("mfctscan_goroutines", "gauge", "Goroutines that currently exist.")
+	fmt.Fprintf(w, "mfctscan_goroutines %d\n", runtime.NumGoroutine())
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jasonmf/mfctscan/ctscan"
+)
+
+// defaultColumns returns the column names written when -columns isn't given:
+// the standard four followed by those enabled by the optional column flags.
+func defaultColumns() []string {
+	names := []string{"source", "name", "address", "error"}
+	if *fStatus {
+		names = append(names, "status")
+	}
+	if *fProbeWildcards {
+		names = append(names, "probe")
+	}
+	if *fCollapseNames {
+		names = append(names, "cert_count")
+	}
+	if *fIssuerInfo {
+		names = append(names, "issuer_org", "issuer_cn")
+	}
+	if *fValidity {
+		names = append(names, "not_before", "not_after")
+	}
+	if *fAggregateValidity {
+		names = append(names, "first_seen", "last_seen")
+	}
+	if *fCertIDs {
+		names = append(names, "serial", "fingerprint")
+	}
+	if *fCNAME {
+		names = append(names, "cname")
+	}
+	if *fMX {
+		names = append(names, "mx")
+	}
+	if *fTXT {
+		names = append(names, "txt")
+	}
+	if *fPTR {
+		names = append(names, "ptr")
+	}
+	if *fASN {
+		names = append(names, "asn", "asn_org")
+	}
+	if *fRDAP {
+		names = append(names, "registrar", "registered", "rdap_error")
+	}
+	if *fProbeHTTP {
+		names = append(names, "http_status", "http_server", "http_error")
+	}
+	if *fDebugRaw {
+		names = append(names, "raw")
+	}
+	return names
+}
+
+// hasColumn reports whether name is among names.
+func hasColumn(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newOutput returns an Output that writes records to w in the given format,
+// which has already been checked. The JSON formats only limit their fields to
+// columns when -columns is given.
+func newOutput(format string, w io.Writer, columns []string) ctscan.Output {
+	switch format {
+	case "jsonl":
+		jsonl := ctscan.NewJSONLOutput(w)
+		if *fColumns != "" {
+			jsonl.Columns = columns
+		}
+		return jsonl
+	case "json":
+		array := ctscan.NewJSONOutput(w, *fPretty)
+		if *fColumns != "" {
+			array.Columns = columns
+		}
+		return array
+	case "edges":
+		return ctscan.NewEdgesOutput(w)
+	case "protobuf":
+		return ctscan.NewProtobufOutput(w)
+	}
+	return ctscan.NewCSVOutput(w, columns)
+}
+
+// pendingOutput is an Output that can hold the latest records back past a
+// Flush, like the SQLite output, which commits in batches.
+type pendingOutput interface {
+	// Pending returns how many of the records written last aren't out yet.
+	Pending() int
+}
+
+// formatExtensions are the file name extensions for each -format.
+var formatExtensions = map[string]string{
+	"csv":      ".csv",
+	"json":     ".json",
+	"jsonl":    ".jsonl",
+	"edges":    ".csv",
+	"protobuf": ".pb",
+}
+
+// splitOutput writes each record to a file for its source domain in dir, in
+// the given format. Files are created when their first record arrives and
+// closed when the splitOutput is. Like the other outputs it's only used from
+// the output loop, so writes to each file are never concurrent.
+type splitOutput struct {
+	dir     string
+	format  string
+	columns []string
+	files   map[string]*splitFile
+}
+
+type splitFile struct {
+	f      *os.File
+	output ctscan.Output
+}
+
+func newSplitOutput(dir, format string, columns []string) (*splitOutput, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &splitOutput{
+		dir:     dir,
+		format:  format,
+		columns: columns,
+		files:   map[string]*splitFile{},
+	}, nil
+}
+
+func (o *splitOutput) Write(record ctscan.Record) error {
+	file, present := o.files[record.From]
+	if !present {
+		path := filepath.Join(o.dir, fileName(record.From)+formatExtensions[o.format])
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		file = &splitFile{f: f, output: newOutput(o.format, f, o.columns)}
+		o.files[record.From] = file
+	}
+	return file.output.Write(record)
+}
+
+// Flush flushes every file.
+func (o *splitOutput) Flush() error {
+	for _, file := range o.files {
+		if err := file.output.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close finishes and closes every file, returning the first error.
+func (o *splitOutput) Close() error {
+	var firstErr error
+	for _, file := range o.files {
+		var err error
+		if closer, ok := file.output.(io.Closer); ok {
+			err = closer.Close()
+		} else {
+			err = file.output.Flush()
+		}
+		if closeErr := file.f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// fileName makes a domain safe to use as a file name, replacing anything
+// other than letters, digits, dots, hyphens, and underscores.
+func fileName(domain string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, domain)
+	// no hidden files, or . and ..
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
+
+// ipsOutput collects the unique addresses of every record, writing them one
+// per line, sorted, when it's closed.
+type ipsOutput struct {
+	w   io.Writer
+	ips map[string]net.IP
+}
+
+func newIPsOutput(w io.Writer) *ipsOutput {
+	return &ipsOutput{
+		w:   w,
+		ips: map[string]net.IP{},
+	}
+}
+
+func (o *ipsOutput) Write(record ctscan.Record) error {
+	for _, addr := range record.Addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			// key on the parsed form so different spellings of an address
+			// are only listed once
+			o.ips[ip.String()] = ip
+		}
+	}
+	return nil
+}
+
+// Flush does nothing; the addresses aren't known until the run is over.
+func (o *ipsOutput) Flush() error {
+	return nil
+}
+
+// Close writes the addresses, IPv4 before IPv6 and each in numeric order.
+func (o *ipsOutput) Close() error {
+	ips := make([]net.IP, 0, len(o.ips))
+	for _, ip := range o.ips {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		a, b := ips[i].To4(), ips[j].To4()
+		if (a == nil) != (b == nil) {
+			return a != nil
+		}
+		if a == nil {
+			a, b = ips[i].To16(), ips[j].To16()
+		}
+		return bytes.Compare(a, b) < 0
+	})
+	for _, ip := range ips {
+		if _, err := fmt.Fprintln(o.w, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namesOutput collects the unique names of every record, writing them one per
+// line, sorted, when it's closed. Wildcard names are cut down to the domain
+// they cover unless wildcards is set, and names that aren't DNS names are
+// left out.
+type namesOutput struct {
+	w         io.Writer
+	wildcards bool
+	names     map[string]struct{}
+}
+
+func newNamesOutput(w io.Writer, wildcards bool) *namesOutput {
+	return &namesOutput{
+		w:         w,
+		wildcards: wildcards,
+		names:     map[string]struct{}{},
+	}
+}
+
+func (o *namesOutput) Write(record ctscan.Record) error {
+	name := strings.TrimSuffix(strings.ToLower(record.Name), ".")
+	if !o.wildcards {
+		name = strings.TrimPrefix(name, "*.")
+	}
+	if !ctscan.IsResolvable(strings.TrimPrefix(name, "*.")) {
+		// a failed scan, or not a DNS name
+		return nil
+	}
+	o.names[name] = struct{}{}
+	return nil
+}
+
+// Flush does nothing; the names aren't known until the run is over.
+func (o *namesOutput) Flush() error {
+	return nil
+}
+
+// Close writes the names in sorted order.
+func (o *namesOutput) Close() error {
+	for _, name := range sortedKeys(o.names) {
+		if _, err := fmt.Fprintln(o.w, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
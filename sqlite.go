@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jasonmf/mfctscan/ctscan"
+	// a pure Go driver, so the build doesn't need cgo
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDriver is the database/sql driver name registered by
+// modernc.org/sqlite.
+const sqliteDriver = "sqlite"
+
+// sqliteBatchSize is how many records go into each transaction. Committing
+// every record is very slow; batching keeps the database close to current
+// without paying that cost.
+const sqliteBatchSize = 500
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS certs (
+	source TEXT NOT NULL,
+	name TEXT NOT NULL,
+	issuer TEXT,
+	not_before INTEGER,
+	not_after INTEGER
+);
+CREATE TABLE IF NOT EXISTS addresses (
+	name TEXT NOT NULL,
+	address TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS addresses_name ON addresses (name);
+`
+
+// sqliteWriter stores records in a SQLite database instead of writing CSV.
+// Each record becomes a row in certs and one row in addresses per resolved
+// address, joined on name.
+type sqliteWriter struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	pending int
+}
+
+// newSQLiteWriter opens or creates the database at path and makes sure the
+// tables exist.
+func newSQLiteWriter(path string) (*sqliteWriter, error) {
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating tables: %w", err)
+	}
+	return &sqliteWriter{db: db}, nil
+}
+
+// Write adds a record to the current transaction, committing it once it
+// holds sqliteBatchSize records.
+func (s *sqliteWriter) Write(record ctscan.Record) error {
+	if record.Name == "" {
+		// a failed scan, which has no place in the tables
+		return nil
+	}
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return fmt.Errorf("starting transaction: %w", err)
+		}
+		s.tx = tx
+	}
+	_, err := s.tx.Exec(
+		"INSERT INTO certs (source, name, issuer, not_before, not_after) VALUES (?, ?, ?, ?, ?)",
+		record.From, record.Name, record.Issuer, record.NotBeforeTime, record.NotAfterTime,
+	)
+	if err != nil {
+		return fmt.Errorf("inserting cert: %w", err)
+	}
+	for _, addr := range record.Addrs {
+		_, err := s.tx.Exec("INSERT INTO addresses (name, address) VALUES (?, ?)", record.Name, addr)
+		if err != nil {
+			return fmt.Errorf("inserting address: %w", err)
+		}
+	}
+	s.pending++
+	if s.pending >= sqliteBatchSize {
+		return s.commit()
+	}
+	return nil
+}
+
+// Pending returns how many records are waiting to be committed.
+func (s *sqliteWriter) Pending() int {
+	return s.pending
+}
+
+// Flush does nothing. Rows are committed in batches of sqliteBatchSize and
+// on Close; committing on every -flush-interval tick would break the batches
+// into small transactions and lose what batching buys.
+func (s *sqliteWriter) Flush() error {
+	return nil
+}
+
+// commit commits the current transaction, if there is one.
+func (s *sqliteWriter) commit() error {
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Commit()
+	s.tx = nil
+	s.pending = 0
+	if err != nil {
+		return fmt.Errorf("committing: %w", err)
+	}
+	return nil
+}
+
+// Close commits any pending records and closes the database.
+func (s *sqliteWriter) Close() error {
+	if err := s.commit(); err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jasonmf/mfctscan/ctscan"
+)
+
+// A summary tallies the results of a run for the -summary report.
+type summary struct {
+	start      time.Time
+	scanErrors int
+	timedOut   int
+	names      int
+	resolved   int
+	noAddrs    int
+	skipped    int
+	failed     int
+	nxdomain   int
+	dnsTimeout int
+	otherErr   int
+	// dropped counts records removed by each enabled filter
+	dropped map[string]*int
+	// cache reports the resolver's DNS cache hits and misses, if it's
+	// enabled
+	cache func() (hits, misses int64)
+	// requests counts the HTTP requests made to the CT source
+	requests *requestCounter
+	// probes counts the requests made by -probe-http, if it's enabled
+	probes *requestCounter
+}
+
+// add counts a single output record.
+func (s *summary) add(record ctscan.Record) {
+	if record.Status() == ctscan.StatusScanError {
+		if errors.Is(record.Err, ctscan.ErrDomainTimeout) {
+			s.timedOut++
+		} else {
+			s.scanErrors++
+		}
+		return
+	}
+	s.names++
+	switch {
+	case record.Err != nil:
+		s.failed++
+		switch {
+		case errors.Is(record.Err, ctscan.ErrDNSTimeout):
+			s.dnsTimeout++
+		case ctscan.IsNotFound(record.Err):
+			s.nxdomain++
+		default:
+			s.otherErr++
+		}
+	case record.Skipped:
+		s.skipped++
+	case len(record.Addrs) == 0:
+		s.noAddrs++
+	default:
+		s.resolved++
+	}
+}
+
+// write prints the report.
+func (s *summary) write(w io.Writer, domains int) {
+	fmt.Fprintf(w, "domains scanned:  %d\n", domains)
+	if s.scanErrors > 0 {
+		fmt.Fprintf(w, "  failed:         %d\n", s.scanErrors)
+	}
+	if s.timedOut > 0 {
+		fmt.Fprintf(w, "  timed out:      %d\n", s.timedOut)
+	}
+	for _, filter := range sortedKeys(s.dropped) {
+		fmt.Fprintf(w, "dropped %-9s %d\n", filter+":", *s.dropped[filter])
+	}
+	fmt.Fprintf(w, "unique names:     %d\n", s.names)
+	fmt.Fprintf(w, "resolved:         %d\n", s.resolved)
+	fmt.Fprintf(w, "no addresses:     %d\n", s.noAddrs)
+	if s.skipped > 0 {
+		fmt.Fprintf(w, "not resolved:     %d\n", s.skipped)
+	}
+	fmt.Fprintf(w, "failed:           %d\n", s.failed)
+	fmt.Fprintf(w, "  nxdomain:       %d\n", s.nxdomain)
+	fmt.Fprintf(w, "  timeout:        %d\n", s.dnsTimeout)
+	fmt.Fprintf(w, "  other:          %d\n", s.otherErr)
+	if s.cache != nil {
+		hits, misses := s.cache()
+		fmt.Fprintf(w, "dns cache hits:   %d\n", hits)
+		fmt.Fprintf(w, "dns cache misses: %d\n", misses)
+	}
+	if s.requests != nil {
+		s.requests.write(w, "http requests:")
+	}
+	if s.probes != nil {
+		s.probes.write(w, "http probes:")
+	}
+	fmt.Fprintf(w, "runtime:          %s\n", time.Since(s.start).Round(time.Millisecond))
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// A requestCounter is an http.RoundTripper that counts the requests it passes
+// on, by response status, so the cost of a run against the source's rate
+// limits is known.
+type requestCounter struct {
+	next     http.RoundTripper
+	lock     sync.Mutex
+	total    int
+	byStatus map[int]int
+	// failed counts requests that got no response at all
+	failed int
+}
+
+func newRequestCounter(next http.RoundTripper) *requestCounter {
+	return &requestCounter{
+		next:     next,
+		byStatus: map[int]int{},
+	}
+}
+
+func (c *requestCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.total++
+	if err != nil {
+		c.failed++
+	} else {
+		c.byStatus[resp.StatusCode]++
+	}
+	return resp, err
+}
+
+// counts returns a copy of the counts so far.
+func (c *requestCounter) counts() (total int, byStatus map[int]int, failed int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	byStatus = make(map[int]int, len(c.byStatus))
+	for status, n := range c.byStatus {
+		byStatus[status] = n
+	}
+	return c.total, byStatus, c.failed
+}
+
+// write prints the request counts for the summary, under label.
+func (c *requestCounter) write(w io.Writer, label string) {
+	total, byStatus, failed := c.counts()
+	fmt.Fprintf(w, "%-18s%d\n", label, total)
+	for _, status := range sortedKeys(byStatus) {
+		fmt.Fprintf(w, "  status %d:     %d\n", status, byStatus[status])
+	}
+	if failed > 0 {
+		fmt.Fprintf(w, "  no response:    %d\n", failed)
+	}
+}